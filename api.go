@@ -0,0 +1,893 @@
+package cent
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cristosal/cent/pay"
+	"github.com/cristosal/orm"
+)
+
+// APIPrefix is the path under which the versioned json api is served
+const APIPrefix = "/api/v1"
+
+var (
+	errMethodNotAllowed = errors.New("method not allowed")
+	errUnauthorized     = errors.New("a valid api token is required")
+	errForbidden        = errors.New("api token role is not allowed")
+)
+
+func handleAPI(p *pay.StripeProvider, auth *apiAuth) {
+	route := func(path string, read, write Role, h http.HandlerFunc) {
+		http.HandleFunc(APIPrefix+path, auth.protect(read, write, h))
+	}
+
+	route("/customers", RoleViewer, RoleOperator, handleAPICustomers(p))
+	route("/customers/", RoleViewer, RoleOperator, handleAPICustomers(p))
+	route("/plans", RoleViewer, RoleOperator, handleAPIPlans(p))
+	route("/plans/", RoleViewer, RoleOperator, handleAPIPlans(p))
+	route("/prices", RoleViewer, RoleOperator, handleAPIPrices(p))
+	route("/prices/", RoleViewer, RoleOperator, handleAPIPrices(p))
+	route("/subscriptions", RoleViewer, RoleOperator, handleAPISubscriptions(p))
+	route("/subscriptions/", RoleViewer, RoleOperator, handleAPISubscriptions(p))
+	route("/coupons", RoleViewer, RoleOperator, handleAPICoupons(p))
+	route("/coupons/", RoleViewer, RoleOperator, handleAPICoupons(p))
+	route("/entitlements", RoleViewer, RoleViewer, handleAPIEntitlements(p))
+	route("/usage", RoleViewer, RoleOperator, handleAPIUsage(p))
+	route("/checkout", RoleOperator, RoleOperator, handleAPICheckout(p))
+	route("/portal", RoleOperator, RoleOperator, handleAPIPortal(p))
+	route("/sync", RoleOperator, RoleOperator, handleAPISync(p))
+	http.HandleFunc(OpenAPIPath, handleOpenAPI())
+}
+
+// setSeatActor sets who makes a seat change through the api, which is never taken from the request.
+// Admin tokens manage every seat like the web ui, other tokens act as the seat user that the token is named after.
+func setSeatActor(r *http.Request, su *pay.SubscriptionUser) {
+	su.Actor = ""
+	su.System = false
+
+	u := apiUser(r)
+	if u == nil {
+		return
+	}
+
+	if u.Role.Allows(RoleAdmin) {
+		su.System = true
+		return
+	}
+
+	su.Actor = u.Username
+}
+
+// checkoutResponse is the body returned by the checkout endpoint
+type checkoutResponse struct {
+	URL string
+}
+
+// portalResponse is the body returned by the portal endpoint
+type portalResponse struct {
+	URL string
+}
+
+// apiError is the body returned when a request fails
+type apiError struct {
+	Error string
+}
+
+func handleAPICustomers(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		segments := pathSegments(r, "/customers")
+
+		if len(segments) == 0 {
+			switch r.Method {
+			case http.MethodGet:
+				q := r.URL.Query()
+				if email := q.Get("email"); email != "" {
+					c, err := p.GetCustomerByEmail(email)
+					if err != nil {
+						return err
+					}
+
+					return writeJSON(w, http.StatusOK, c)
+				}
+
+				if providerID := q.Get("provider_id"); providerID != "" {
+					c, err := p.GetCustomerByProvider(pay.ProviderStripe, providerID)
+					if err != nil {
+						return err
+					}
+
+					return writeJSON(w, http.StatusOK, c)
+				}
+
+				customers, err := p.ListAllCustomers()
+				if err != nil {
+					return err
+				}
+
+				return writeJSON(w, http.StatusOK, orEmpty(customers))
+			case http.MethodPost:
+				var c pay.Customer
+				if err := decodeJSON(r, &c); err != nil {
+					return err
+				}
+
+				if err := p.AddCustomer(&c); err != nil {
+					return err
+				}
+
+				return writeJSON(w, http.StatusCreated, &c)
+			}
+
+			return errMethodNotAllowed
+		}
+
+		if len(segments) > 2 || (len(segments) == 2 && segments[1] != "payment_methods") {
+			return orm.ErrNotFound
+		}
+
+		id, err := parseID(segments[0])
+		if err != nil {
+			return err
+		}
+
+		c, err := p.GetCustomerByID(id)
+		if err != nil {
+			return err
+		}
+
+		if len(segments) == 2 {
+			if r.Method != http.MethodGet {
+				return errMethodNotAllowed
+			}
+
+			methods, err := p.ListPaymentMethodsByCustomerID(c.ID)
+			if err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, orEmpty(methods))
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			return writeJSON(w, http.StatusOK, c)
+		case http.MethodPut:
+			var update pay.Customer
+			if err := decodeJSON(r, &update); err != nil {
+				return err
+			}
+
+			update.ID = c.ID
+			update.Provider = c.Provider
+			update.ProviderID = c.ProviderID
+
+			if err := p.UpdateCustomer(&update); err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, &update)
+		case http.MethodDelete:
+			if err := p.RemoveCustomerByProviderID(c.ProviderID); err != nil {
+				return err
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+
+		return errMethodNotAllowed
+	})
+}
+
+func handleAPIPlans(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		segments := pathSegments(r, "/plans")
+
+		if len(segments) == 0 {
+			switch r.Method {
+			case http.MethodGet:
+				var (
+					q     = r.URL.Query()
+					plans []pay.Plan
+					err   error
+				)
+
+				switch {
+				case q.Get("name") != "":
+					pl, err := p.GetPlanByName(q.Get("name"))
+					if err != nil {
+						return err
+					}
+
+					return writeJSON(w, http.StatusOK, pl)
+				case q.Get("provider_id") != "":
+					pl, err := p.GetPlanByProviderID(pay.ProviderStripe, q.Get("provider_id"))
+					if err != nil {
+						return err
+					}
+
+					return writeJSON(w, http.StatusOK, pl)
+				case q.Get("username") != "":
+					plans, err = p.GetPlansByUsername(q.Get("username"))
+				case q.Get("active") == "true":
+					plans, err = p.ListActivePlans()
+				default:
+					plans, err = p.ListPlans()
+				}
+
+				if err != nil {
+					return err
+				}
+
+				return writeJSON(w, http.StatusOK, orEmpty(plans))
+			case http.MethodPost:
+				var pl pay.Plan
+				if err := decodeJSON(r, &pl); err != nil {
+					return err
+				}
+
+				if err := p.AddPlan(&pl); err != nil {
+					return err
+				}
+
+				return writeJSON(w, http.StatusCreated, &pl)
+			}
+
+			return errMethodNotAllowed
+		}
+
+		if len(segments) > 2 || (len(segments) == 2 && segments[1] != "entitlements") {
+			return orm.ErrNotFound
+		}
+
+		id, err := parseID(segments[0])
+		if err != nil {
+			return err
+		}
+
+		pl, err := p.GetPlanByID(id)
+		if err != nil {
+			return err
+		}
+
+		if len(segments) == 2 {
+			switch r.Method {
+			case http.MethodGet:
+			case http.MethodPut:
+				var ents []pay.Entitlement
+				if err := decodeJSON(r, &ents); err != nil {
+					return err
+				}
+
+				if err := p.SetPlanEntitlements(pl.ID, ents); err != nil {
+					return err
+				}
+			default:
+				return errMethodNotAllowed
+			}
+
+			ents, err := p.ListPlanEntitlements(pl.ID)
+			if err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, orEmpty(ents))
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			return writeJSON(w, http.StatusOK, pl)
+		case http.MethodPut:
+			// fields left out of the body keep their stored values
+			update := *pl
+			if err := decodeJSON(r, &update); err != nil {
+				return err
+			}
+
+			update.ID = pl.ID
+			update.Provider = pl.Provider
+			update.ProviderID = pl.ProviderID
+
+			if err := p.UpdatePlan(&update); err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, &update)
+		case http.MethodDelete:
+			if err := p.RemovePlanByProviderID(pl.ProviderID); err != nil {
+				return err
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+
+		return errMethodNotAllowed
+	})
+}
+
+func handleAPIPrices(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		segments := pathSegments(r, "/prices")
+
+		if len(segments) == 0 {
+			switch r.Method {
+			case http.MethodGet:
+				q := r.URL.Query()
+				if providerID := q.Get("provider_id"); providerID != "" {
+					pr, err := p.GetPriceByProvider(pay.ProviderStripe, providerID)
+					if err != nil {
+						return err
+					}
+
+					return writeJSON(w, http.StatusOK, pr)
+				}
+
+				var (
+					prices []pay.Price
+					err    error
+				)
+
+				if planID := q.Get("plan_id"); planID != "" {
+					id, parseErr := parseID(planID)
+					if parseErr != nil {
+						return parseErr
+					}
+
+					prices, err = p.ListPricesByPlanID(id)
+				} else {
+					prices, err = p.ListAllPrices()
+				}
+
+				if err != nil {
+					return err
+				}
+
+				return writeJSON(w, http.StatusOK, orEmpty(prices))
+			case http.MethodPost:
+				var pr pay.Price
+				if err := decodeJSON(r, &pr); err != nil {
+					return err
+				}
+
+				if err := p.AddPrice(&pr); err != nil {
+					return err
+				}
+
+				return writeJSON(w, http.StatusCreated, &pr)
+			}
+
+			return errMethodNotAllowed
+		}
+
+		if len(segments) != 1 {
+			return orm.ErrNotFound
+		}
+
+		id, err := parseID(segments[0])
+		if err != nil {
+			return err
+		}
+
+		pr, err := p.GetPriceByID(id)
+		if err != nil {
+			return err
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			return writeJSON(w, http.StatusOK, pr)
+		case http.MethodPut:
+			var update pay.Price
+			if err := decodeJSON(r, &update); err != nil {
+				return err
+			}
+
+			pr.Active = update.Active
+			pr.Nickname = update.Nickname
+
+			// metadata is kept when the body leaves it out, an empty object clears it
+			if update.Metadata != nil {
+				pr.Metadata = update.Metadata
+			}
+
+			if err := p.UpdatePrice(pr); err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, pr)
+		}
+
+		return errMethodNotAllowed
+	})
+}
+
+func handleAPISubscriptions(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		segments := pathSegments(r, "/subscriptions")
+
+		if len(segments) == 0 {
+			if r.Method != http.MethodGet {
+				return errMethodNotAllowed
+			}
+
+			var (
+				q    = r.URL.Query()
+				subs []pay.Subscription
+				err  error
+			)
+
+			switch {
+			case q.Get("provider_id") != "":
+				sub, err := p.GetSubscriptionByProvider(pay.ProviderStripe, q.Get("provider_id"))
+				if err != nil {
+					return err
+				}
+
+				return writeJSON(w, http.StatusOK, sub)
+			case q.Get("username") != "":
+				subs, err = p.ListSubscriptionsByUsername(q.Get("username"))
+			case q.Get("customer_id") != "":
+				id, parseErr := parseID(q.Get("customer_id"))
+				if parseErr != nil {
+					return parseErr
+				}
+
+				subs, err = p.ListSubscriptionsByCustomerID(id)
+			case q.Get("plan_id") != "":
+				id, parseErr := parseID(q.Get("plan_id"))
+				if parseErr != nil {
+					return parseErr
+				}
+
+				subs, err = p.ListSubscriptionsByPlanID(id)
+			default:
+				subs, err = p.ListAllSubscriptions()
+			}
+
+			if errors.Is(err, pay.ErrSubscriptionNotFound) {
+				err = nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, orEmpty(subs))
+		}
+
+		id, err := parseID(segments[0])
+		if err != nil {
+			return err
+		}
+
+		sub, err := p.GetSubscriptionByID(id)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(segments) == 1 && r.Method == http.MethodGet:
+			return writeJSON(w, http.StatusOK, sub)
+		case len(segments) == 1:
+			return errMethodNotAllowed
+		case len(segments) == 2 && segments[1] == "seats":
+			if r.Method != http.MethodGet {
+				return errMethodNotAllowed
+			}
+
+			seats, err := p.GetSeats(sub.ID)
+			if err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, seats)
+		case len(segments) == 2 && segments[1] == "usage":
+			if r.Method != http.MethodGet {
+				return errMethodNotAllowed
+			}
+
+			req := pay.UsageRequest{SubscriptionID: sub.ID, Meter: r.URL.Query().Get("meter")}
+			if err := parseTimeQuery(r, "since", &req.Since); err != nil {
+				return err
+			}
+
+			if err := parseTimeQuery(r, "until", &req.Until); err != nil {
+				return err
+			}
+
+			usage, err := p.ListUsage(&req)
+			if err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, orEmpty(usage))
+		case len(segments) == 2 && segments[1] == "discount":
+			switch r.Method {
+			case http.MethodPut:
+				var req pay.DiscountRequest
+				if err := decodeJSON(r, &req); err != nil {
+					return err
+				}
+
+				req.SubscriptionID = sub.ID
+				if err := p.ApplySubscriptionDiscount(&req); err != nil {
+					return err
+				}
+
+				w.WriteHeader(http.StatusAccepted)
+				return nil
+			case http.MethodDelete:
+				if err := p.RemoveSubscriptionDiscount(sub.ID); err != nil {
+					return err
+				}
+
+				w.WriteHeader(http.StatusAccepted)
+				return nil
+			}
+
+			return errMethodNotAllowed
+		case segments[1] != "users" || len(segments) > 3:
+			return orm.ErrNotFound
+		case len(segments) == 3 && r.Method == http.MethodPut:
+			var su pay.SubscriptionUser
+			if err := decodeJSON(r, &su); err != nil {
+				return err
+			}
+
+			su.SubscriptionID = sub.ID
+			su.Username = segments[2]
+			setSeatActor(r, &su)
+			if err := p.SetSubscriptionUserRole(&su); err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, &su)
+		case len(segments) == 3:
+			if r.Method != http.MethodDelete {
+				return errMethodNotAllowed
+			}
+
+			su := pay.SubscriptionUser{SubscriptionID: sub.ID, Username: segments[2]}
+			setSeatActor(r, &su)
+			if err := p.RemoveSubscriptionUser(&su); err != nil {
+				return err
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			users, err := p.ListSubscriptionUsers(sub.ID)
+			if err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, orEmpty(users))
+		case http.MethodPost:
+			var su pay.SubscriptionUser
+			if err := decodeJSON(r, &su); err != nil {
+				return err
+			}
+
+			su.SubscriptionID = sub.ID
+			setSeatActor(r, &su)
+			if err := p.AddSubscriptionUser(&su); err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusCreated, &su)
+		}
+
+		return errMethodNotAllowed
+	})
+}
+
+func handleAPICoupons(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		segments := pathSegments(r, "/coupons")
+
+		if len(segments) == 0 {
+			switch r.Method {
+			case http.MethodGet:
+				coupons, err := p.ListCoupons()
+				if err != nil {
+					return err
+				}
+
+				return writeJSON(w, http.StatusOK, orEmpty(coupons))
+			case http.MethodPost:
+				var c pay.Coupon
+				if err := decodeJSON(r, &c); err != nil {
+					return err
+				}
+
+				if err := p.AddCoupon(&c); err != nil {
+					return err
+				}
+
+				return writeJSON(w, http.StatusCreated, &c)
+			}
+
+			return errMethodNotAllowed
+		}
+
+		if len(segments) > 2 || (len(segments) == 2 && segments[1] != "promotion_codes") {
+			return orm.ErrNotFound
+		}
+
+		id, err := parseID(segments[0])
+		if err != nil {
+			return err
+		}
+
+		c, err := p.GetCouponByID(id)
+		if err != nil {
+			return err
+		}
+
+		if len(segments) == 1 {
+			if r.Method != http.MethodGet {
+				return errMethodNotAllowed
+			}
+
+			return writeJSON(w, http.StatusOK, c)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			codes, err := p.ListPromotionCodesByCouponID(c.ID)
+			if err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, orEmpty(codes))
+		case http.MethodPost:
+			var pc pay.PromotionCode
+			if err := decodeJSON(r, &pc); err != nil {
+				return err
+			}
+
+			pc.CouponID = c.ID
+			if err := p.AddPromotionCode(&pc); err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusCreated, &pc)
+		}
+
+		return errMethodNotAllowed
+	})
+}
+
+func handleAPIEntitlements(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+
+		q := r.URL.Query()
+		if q.Get("username") == "" {
+			return ErrBadRequest
+		}
+
+		if q.Get("feature") != "" {
+			ent, err := p.CheckEntitlement(&pay.EntitlementCheck{
+				Username: q.Get("username"),
+				Feature:  q.Get("feature"),
+			})
+			if err != nil {
+				return err
+			}
+
+			return writeJSON(w, http.StatusOK, ent)
+		}
+
+		ents, err := p.ListEntitlementsByUsername(q.Get("username"))
+		if err != nil {
+			return err
+		}
+
+		return writeJSON(w, http.StatusOK, orEmpty(ents))
+	})
+}
+
+func handleAPIUsage(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return errMethodNotAllowed
+		}
+
+		var rec pay.UsageRecord
+		if err := decodeJSON(r, &rec); err != nil {
+			return err
+		}
+
+		if rec.IdempotencyKey == "" {
+			rec.IdempotencyKey = r.Header.Get(HeaderIdempotencyKey)
+		}
+
+		if err := p.AddUsageRecord(&rec); err != nil {
+			return err
+		}
+
+		return writeJSON(w, http.StatusCreated, &rec)
+	})
+}
+
+func handleAPICheckout(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return errMethodNotAllowed
+		}
+
+		var req pay.CheckoutRequest
+		if err := decodeJSON(r, &req); err != nil {
+			return err
+		}
+
+		url, err := p.Checkout(&req)
+		if err != nil {
+			return err
+		}
+
+		return writeJSON(w, http.StatusOK, &checkoutResponse{URL: url})
+	})
+}
+
+func handleAPIPortal(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return errMethodNotAllowed
+		}
+
+		var req pay.PortalRequest
+		if err := decodeJSON(r, &req); err != nil {
+			return err
+		}
+
+		url, err := p.CreatePortalSession(req.CustomerID, req.ReturnURL)
+		if err != nil {
+			return err
+		}
+
+		return writeJSON(w, http.StatusOK, &portalResponse{URL: url})
+	})
+}
+
+func handleAPISync(p *pay.StripeProvider) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return errMethodNotAllowed
+		}
+
+		if err := p.Sync(); err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+// pathSegments returns the parts of the request path that follow the resource
+func pathSegments(r *http.Request, resource string) []string {
+	rest := strings.TrimPrefix(r.URL.Path, APIPrefix+resource)
+	rest = strings.Trim(rest, "/")
+	if rest == "" {
+		return nil
+	}
+
+	return strings.Split(rest, "/")
+}
+
+func parseID(s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrBadRequest
+	}
+
+	return id, nil
+}
+
+// parseTimeQuery sets t to the RFC3339 time in the query parameter, leaving it zero when the parameter is missing
+func parseTimeQuery(r *http.Request, name string, t *time.Time) error {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return ErrBadRequest
+	}
+
+	*t = parsed
+	return nil
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return ErrBadRequest
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// orEmpty ensures that empty lists are encoded as an empty json array instead of null
+func orEmpty[T any](v []T) []T {
+	if v == nil {
+		return []T{}
+	}
+
+	return v
+}
+
+// apiStatus maps an error returned by the provider to an http status code
+func apiStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrBadRequest),
+		errors.Is(err, pay.ErrInvalidSchedule),
+		errors.Is(err, pay.ErrTrialOnOneTimePrice),
+		errors.Is(err, pay.ErrMissingCustomer),
+		errors.Is(err, pay.ErrEmptyCheckout),
+		errors.Is(err, pay.ErrInvalidQuantity),
+		errors.Is(err, pay.ErrPromotionCodesWithCoupon),
+		errors.Is(err, pay.ErrInvalidSeatRole),
+		errors.Is(err, pay.ErrActorRequired),
+		errors.Is(err, pay.ErrInvalidMaxSeats),
+		errors.Is(err, pay.ErrFeatureRequired),
+		errors.Is(err, pay.ErrDuplicateFeature),
+		errors.Is(err, pay.ErrInvalidLimit),
+		errors.Is(err, pay.ErrMeterRequired),
+		errors.Is(err, pay.ErrInvalidCouponDiscount),
+		errors.Is(err, pay.ErrInvalidCouponDuration),
+		errors.Is(err, pay.ErrInvalidDiscount),
+		errors.Is(err, pay.ErrInvalidUsageTimestamp):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, pay.ErrSeatForbidden),
+		errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, pay.ErrSeatLimitReached),
+		errors.Is(err, pay.ErrLastOwner):
+		return http.StatusConflict
+	case errors.Is(err, errMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, orm.ErrNotFound),
+		errors.Is(err, pay.ErrSubscriptionNotFound),
+		errors.Is(err, pay.ErrNotSeatUser),
+		errors.Is(err, pay.ErrMeterNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func wrapAPI(h wrappedHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h(w, r); err != nil {
+			status := apiStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("ERROR: %v", err)
+			}
+
+			writeJSON(w, status, &apiError{Error: err.Error()})
+		}
+	}
+}
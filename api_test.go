@@ -0,0 +1,39 @@
+package cent
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cristosal/cent/pay"
+)
+
+func TestSetSeatActor(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       *User
+		wantActor  string
+		wantSystem bool
+	}{
+		{"no token", nil, "", false},
+		{"admin token", &User{Username: "ops", Role: RoleAdmin}, "", true},
+		{"operator token", &User{Username: "jane", Role: RoleOperator}, "jane", false},
+		{"viewer token", &User{Username: "john", Role: RoleViewer}, "john", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			if tt.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), apiUserKey{}, tt.user))
+			}
+
+			// the actor given in the body is always replaced
+			su := pay.SubscriptionUser{Actor: "mallory", System: true}
+			setSeatActor(r, &su)
+			if su.Actor != tt.wantActor || su.System != tt.wantSystem {
+				t.Errorf("setSeatActor() = %q, %v, want %q, %v", su.Actor, su.System, tt.wantActor, tt.wantSystem)
+			}
+		})
+	}
+}
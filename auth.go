@@ -0,0 +1,614 @@
+package cent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cristosal/cent/templates"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role of a web ui user. Each role is allowed everything the roles before it are
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // can view all pages
+	RoleOperator Role = "operator" // can create entities, add seats, checkout and sync
+	RoleAdmin    Role = "admin"    // can delete entities and remove seats
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrLoginNotSupported  = errors.New("login is handled by the reverse proxy")
+)
+
+const (
+	sessionCookie   = "cent_session"
+	oidcStateCookie = "cent_oidc_state"
+)
+
+// Valid is true when r is one of the known roles
+func (r Role) Valid() bool {
+	return roleRank[r] > 0
+}
+
+// Allows is true when r grants the permissions of the required role
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && roleRank[r] >= roleRank[required]
+}
+
+// User that is signed in to the web ui
+type User struct {
+	Username string
+	Role     Role
+}
+
+// Authenticator identifies the users of the web ui
+type Authenticator interface {
+	// Authenticate returns the user making the request without a session, or nil when the user has to login
+	Authenticate(r *http.Request) *User
+
+	// Login serves the login route and starts a session once the user has been identified
+	Login(w http.ResponseWriter, r *http.Request, sessions *Sessions) error
+}
+
+// Sessions issues and verifies the signed cookies which keep users signed in
+type Sessions struct {
+	secret     []byte
+	maxAge     time.Duration
+	trustProxy bool
+}
+
+type sessionData struct {
+	Username  string
+	Role      Role
+	ExpiresAt int64
+}
+
+// NewSessions creates sessions signed with secret. A random secret is used when it is empty,
+// in which case sessions do not survive a restart.
+func NewSessions(secret string, maxAge time.Duration) *Sessions {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(fmt.Errorf("error generating session secret: %w", err))
+		}
+	}
+
+	if maxAge == 0 {
+		maxAge = time.Hour * 12
+	}
+
+	return &Sessions{secret: key, maxAge: maxAge}
+}
+
+// TrustProxy makes the sessions trust the X-Forwarded-Proto header, which must only be done behind a reverse proxy that sets it
+func (s *Sessions) TrustProxy(trust bool) {
+	s.trustProxy = trust
+}
+
+// secure is true when the request arrived over tls, either directly or through a trusted tls terminating proxy
+func (s *Sessions) secure(r *http.Request) bool {
+	return r.TLS != nil || (s.trustProxy && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https"))
+}
+
+// Start a session for u. The cookie is only sent over tls when r arrived over tls.
+func (s *Sessions) Start(w http.ResponseWriter, r *http.Request, u *User) error {
+	data, err := json.Marshal(&sessionData{
+		Username:  u.Username,
+		Role:      u.Role,
+		ExpiresAt: time.Now().Add(s.maxAge).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    payload + "." + s.sign(payload),
+		Path:     "/",
+		MaxAge:   int(s.maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   s.secure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// User returns the user of the session in r or nil if there is no valid session
+func (s *Sessions) User(r *http.Request) *User {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	payload, sig, found := strings.Cut(c.Value, ".")
+	if !found || !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil
+	}
+
+	var sess sessionData
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return nil
+	}
+
+	if time.Now().Unix() > sess.ExpiresAt || !sess.Role.Valid() {
+		return nil
+	}
+
+	return &User{Username: sess.Username, Role: sess.Role}
+}
+
+// End the session by clearing the cookie
+func (s *Sessions) End(w http.ResponseWriter, r *http.Request) {
+	s.clearCookie(w, r, sessionCookie)
+}
+
+func (s *Sessions) clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secure(r),
+	})
+}
+
+func (s *Sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// StaticUser is a user which is configured ahead of time
+type StaticUser struct {
+	PasswordHash string // bcrypt hash of the users password
+	Role         Role
+}
+
+// StaticAuth authenticates users with a username and password against a fixed set of users
+type StaticAuth struct {
+	Users map[string]StaticUser
+}
+
+// HashPassword returns the bcrypt hash of password for use in StaticUser
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// Authenticate always requires a login
+func (*StaticAuth) Authenticate(r *http.Request) *User {
+	return nil
+}
+
+// Login renders the login form and verifies the submitted credentials
+func (a *StaticAuth) Login(w http.ResponseWriter, r *http.Request, sessions *Sessions) error {
+	if r.Method != http.MethodPost {
+		return templates.Login("").Render(r.Context(), w)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	var (
+		username = r.FormValue("username")
+		password = r.FormValue("password")
+	)
+
+	u, exists := a.Users[username]
+	if !exists || bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return templates.Login(ErrInvalidCredentials.Error()).Render(r.Context(), w)
+	}
+
+	if err := sessions.Start(w, r, &User{Username: username, Role: u.Role}); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// ProxyAuth trusts the identity set in request headers by an authenticating reverse proxy.
+// Only use it when cent cannot be reached without going through the proxy.
+type ProxyAuth struct {
+	UserHeader  string // header containing the username, defaults to X-Forwarded-User
+	RoleHeader  string // optional header containing the users role
+	DefaultRole Role   // role given when the role header is missing or invalid
+}
+
+// Authenticate returns the user set by the proxy
+func (a *ProxyAuth) Authenticate(r *http.Request) *User {
+	header := a.UserHeader
+	if header == "" {
+		header = "X-Forwarded-User"
+	}
+
+	username := r.Header.Get(header)
+	if username == "" {
+		return nil
+	}
+
+	role := a.DefaultRole
+	if a.RoleHeader != "" {
+		if headerRole := Role(r.Header.Get(a.RoleHeader)); headerRole.Valid() {
+			role = headerRole
+		}
+	}
+
+	if !role.Valid() {
+		return nil
+	}
+
+	return &User{Username: username, Role: role}
+}
+
+// Login is not supported as the proxy is responsible for signing users in
+func (*ProxyAuth) Login(w http.ResponseWriter, r *http.Request, sessions *Sessions) error {
+	http.Error(w, ErrLoginNotSupported.Error(), http.StatusUnauthorized)
+	return nil
+}
+
+// OIDCAuth signs users in with an OpenID Connect provider using the authorization code flow
+type OIDCAuth struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string          // absolute url of the login route registered with the provider
+	Roles        map[string]Role // roles by email address
+	DefaultRole  Role            // role of users not found in Roles, empty denies them access
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+}
+
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// Authenticate always requires a login
+func (*OIDCAuth) Authenticate(r *http.Request) *User {
+	return nil
+}
+
+// Login redirects the user to the provider and handles the callback with the authorization code
+func (a *OIDCAuth) Login(w http.ResponseWriter, r *http.Request, sessions *Sessions) error {
+	d, err := a.discover()
+	if err != nil {
+		return err
+	}
+
+	q := r.URL.Query()
+	code := q.Get("code")
+	if code == "" {
+		state := make([]byte, 16)
+		if _, err := rand.Read(state); err != nil {
+			return err
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    hex.EncodeToString(state),
+			Path:     "/",
+			MaxAge:   600,
+			HttpOnly: true,
+			Secure:   sessions.secure(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		params := url.Values{
+			"response_type": {"code"},
+			"client_id":     {a.ClientID},
+			"redirect_uri":  {a.RedirectURL},
+			"scope":         {"openid email profile"},
+			"state":         {hex.EncodeToString(state)},
+		}
+
+		http.Redirect(w, r, d.AuthorizationEndpoint+"?"+params.Encode(), http.StatusFound)
+		return nil
+	}
+
+	// the state is only good for one callback
+	c, err := r.Cookie(oidcStateCookie)
+	sessions.clearCookie(w, r, oidcStateCookie)
+	if err != nil || c.Value == "" || c.Value != q.Get("state") {
+		return errors.New("invalid oidc state")
+	}
+
+	token, err := a.exchange(d, code)
+	if err != nil {
+		return err
+	}
+
+	info, err := a.userinfo(d, token)
+	if err != nil {
+		return err
+	}
+
+	role, exists := a.Roles[info.Email]
+	if !exists {
+		role = a.DefaultRole
+	}
+
+	if !role.Valid() {
+		w.WriteHeader(http.StatusForbidden)
+		return templates.Login(fmt.Sprintf("%s is not allowed to access cent", info.Email)).Render(r.Context(), w)
+	}
+
+	username := info.Email
+	if username == "" {
+		username = info.PreferredUsername
+	}
+
+	if err := sessions.Start(w, r, &User{Username: username, Role: role}); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+func (a *OIDCAuth) discover() (*oidcDiscovery, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.discovery != nil {
+		return a.discovery, nil
+	}
+
+	res, err := http.Get(strings.TrimSuffix(a.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching oidc configuration: %w", err)
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching oidc configuration: %s", res.Status)
+	}
+
+	var d oidcDiscovery
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return nil, fmt.Errorf("error decoding oidc configuration: %w", err)
+	}
+
+	a.discovery = &d
+	return &d, nil
+}
+
+// exchange the authorization code for an access token
+func (a *OIDCAuth) exchange(d *oidcDiscovery, code string) (string, error) {
+	res, err := http.PostForm(d.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.RedirectURL},
+		"client_id":     {a.ClientID},
+		"client_secret": {a.ClientSecret},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error exchanging oidc code: %w", err)
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error exchanging oidc code: %s", res.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("error decoding oidc token: %w", err)
+	}
+
+	return token.AccessToken, nil
+}
+
+type oidcUserinfo struct {
+	Email             string `json:"email"`
+	EmailVerified     *bool  `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// userinfo requests the claims of the user who owns the access token
+func (a *OIDCAuth) userinfo(d *oidcDiscovery, accessToken string) (*oidcUserinfo, error) {
+	req, err := http.NewRequest(http.MethodGet, d.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching oidc userinfo: %w", err)
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching oidc userinfo: %s", res.Status)
+	}
+
+	var info oidcUserinfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("error decoding oidc userinfo: %w", err)
+	}
+
+	if info.EmailVerified != nil && !*info.EmailVerified {
+		return nil, fmt.Errorf("email %s is not verified", info.Email)
+	}
+
+	return &info, nil
+}
+
+// webAuth guards the web ui routes
+type webAuth struct {
+	auth     Authenticator
+	sessions *Sessions
+}
+
+// user returns the user making the request or nil when they have to login
+func (a *webAuth) user(r *http.Request) *User {
+	if u := a.sessions.User(r); u != nil {
+		return u
+	}
+
+	return a.auth.Authenticate(r)
+}
+
+// protect requires the read role for GET and HEAD requests and the write role for all other methods.
+// All requests are allowed when no authenticator is configured.
+func (a *webAuth) protect(read, write Role, h http.HandlerFunc) http.HandlerFunc {
+	if a.auth == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.user(r)
+		if u == nil {
+			// requests missing the proxy headers cannot login
+			if _, proxied := a.auth.(*ProxyAuth); proxied {
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		required := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			required = read
+		}
+
+		if !u.Role.Allows(required) {
+			http.Error(w, fmt.Sprintf("%s role required", required), http.StatusForbidden)
+			return
+		}
+
+		ctx := templates.WithUsername(r.Context(), u.Username)
+		h(w, r.WithContext(ctx))
+	}
+}
+
+func (a *webAuth) handleLogin() http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		if a.auth == nil {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return nil
+		}
+
+		if a.user(r) != nil {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return nil
+		}
+
+		return a.auth.Login(w, r, a.sessions)
+	})
+}
+
+func (a *webAuth) handleLogout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.sessions.End(w, r)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
+
+// APIToken is a bearer token which grants a service access to the json api
+type APIToken struct {
+	Name  string // identifies the service holding the token
+	Role  Role
+	Token string
+}
+
+// apiAuth guards the json api routes with bearer tokens
+type apiAuth struct {
+	tokens []APIToken
+}
+
+type apiUserKey struct{}
+
+// apiUser returns the principal of an authenticated api request
+func apiUser(r *http.Request) *User {
+	u, _ := r.Context().Value(apiUserKey{}).(*User)
+	return u
+}
+
+// user returns the principal of the bearer token in the request or nil when the token is missing or unknown
+func (a *apiAuth) user(r *http.Request) *User {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return nil
+	}
+
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return &User{Username: t.Name, Role: t.Role}
+		}
+	}
+
+	return nil
+}
+
+// protect requires a token with the read role for GET and HEAD requests, the admin role for DELETE requests
+// and the write role for all other methods
+func (a *apiAuth) protect(read, write Role, h http.HandlerFunc) http.HandlerFunc {
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		u := a.user(r)
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return errUnauthorized
+		}
+
+		required := write
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			required = read
+		case http.MethodDelete:
+			required = RoleAdmin
+		}
+
+		if !u.Role.Allows(required) {
+			return fmt.Errorf("%w: %s role required", errForbidden, required)
+		}
+
+		ctx := context.WithValue(r.Context(), apiUserKey{}, u)
+		h(w, r.WithContext(ctx))
+		return nil
+	})
+}
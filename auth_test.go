@@ -0,0 +1,63 @@
+package cent
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionsSecure(t *testing.T) {
+	tests := []struct {
+		name       string
+		tls        bool
+		proto      string
+		trustProxy bool
+		want       bool
+	}{
+		{"plain http", false, "", false, false},
+		{"tls", true, "", false, true},
+		{"forwarded https without a trusted proxy", false, "https", false, false},
+		{"forwarded https behind a trusted proxy", false, "https", true, true},
+		{"forwarded http behind a trusted proxy", false, "http", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+
+			s := NewSessions("secret", 0)
+			s.TrustProxy(tt.trustProxy)
+			if got := s.secure(r); got != tt.want {
+				t.Errorf("secure() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role     Role
+		required Role
+		want     bool
+	}{
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{RoleOperator, RoleViewer, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleAdmin, RoleAdmin, true},
+		{"owner", RoleViewer, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.role.Allows(tt.required); got != tt.want {
+			t.Errorf("%s.Allows(%s) = %v, want %v", tt.role, tt.required, got, tt.want)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/cristosal/cent"
 	"github.com/cristosal/cent/pay"
@@ -19,8 +21,41 @@ var (
 	sqlDriver           string
 	stripeApiKey        string
 	stripeWebhookSecret string
+	perSeatBilling      bool
+	graceDays           int
+	graceReminderDays   []int
 	enableWebUI         bool
-	cmd                 = &cobra.Command{
+	enableAPI           bool
+	authMode            string
+	authUsers           []string
+	authDefaultRole     string
+	oidcIssuer          string
+	oidcClientID        string
+	oidcClientSecret    string
+	oidcRedirectURL     string
+	oidcRoles           []string
+	proxyUserHeader     string
+	proxyRoleHeader     string
+	sessionSecret       string
+	inviteSecret        string
+	apiTokens           []string
+	trustProxy          bool
+	disableJobs         bool
+	hashPasswordCmd     = &cobra.Command{
+		Use:   "hash-password [password]",
+		Short: "prints the bcrypt hash of a password for use with --auth-user",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hash, err := cent.HashPassword(args[0])
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(hash)
+			return nil
+		},
+	}
+	cmd = &cobra.Command{
 		Use:   "centd",
 		Short: "payment microservice",
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -29,16 +64,34 @@ var (
 				return fmt.Errorf("error opening database: %w", err)
 			}
 
+			repo := pay.NewEntityRepo(db)
+			repo.SetInviteSecret(getInviteSecret())
+
 			p := pay.NewStripeProvider(&pay.StripeConfig{
-				Repo:          pay.NewEntityRepo(db),
-				Key:           getStripeApiKey(),
-				WebhookSecret: getStripeWebhookSecret(),
+				Repo:           repo,
+				Key:            getStripeApiKey(),
+				WebhookSecret:  getStripeWebhookSecret(),
+				PerSeatBilling: perSeatBilling,
+				Dunning: pay.DunningPolicy{
+					GraceDays:    graceDays,
+					ReminderDays: graceReminderDays,
+				},
 			})
 
 			if err := p.Init(); err != nil {
 				return fmt.Errorf("error initializing pay: %w", err)
 			}
 
+			auth, err := getAuthenticator()
+			if err != nil {
+				return fmt.Errorf("error configuring authentication: %w", err)
+			}
+
+			tokens, err := getAPITokens()
+			if err != nil {
+				return fmt.Errorf("error configuring api tokens: %w", err)
+			}
+
 			fmt.Println("syncing...")
 			if err := p.Sync(); err != nil {
 				log.Fatal(fmt.Errorf("sync error: %w", err))
@@ -51,6 +104,12 @@ var (
 				HttpAddr:        addr,
 				WebhookEndpoint: "/webhook",
 				EnableWebUI:     enableWebUI,
+				EnableAPI:       enableAPI,
+				Auth:            auth,
+				SessionSecret:   getSessionSecret(),
+				APITokens:       tokens,
+				TrustProxy:      trustProxy || authMode == "proxy",
+				DisableJobs:     disableJobs,
 			})
 
 			return s.Listen()
@@ -60,12 +119,135 @@ var (
 
 func init() {
 	cmd.Flags().BoolVar(&enableWebUI, "web-ui", false, "Enables Web UI")
+	cmd.Flags().BoolVar(&enableAPI, "api", false, "Enables JSON REST API")
 	cmd.Flags().StringVar(&natsURL, "nats", nats.DefaultURL, "NATS connection url")
 	cmd.Flags().StringVar(&sqlDriver, "sql-driver", "pgx", "SQL Data Source Name")
 	cmd.Flags().StringVar(&sqlDSN, "sql-dsn", "", "SQL Data Source Name")
 	cmd.Flags().StringVar(&stripeApiKey, "stripe-api-key", "", "Stripe api key from stripe account")
 	cmd.Flags().StringVar(&stripeWebhookSecret, "stripe-webhook-secret", "", "Stripe webhook secret for verifying webhook post requests")
+	cmd.Flags().BoolVar(&perSeatBilling, "per-seat-billing", false, "Raise the subscription quantity in stripe when users are added beyond its seats")
+	cmd.Flags().IntVar(&graceDays, "grace-days", 0, "Days past due subscriptions stay active after a failed renewal payment")
+	cmd.Flags().IntSliceVar(&graceReminderDays, "grace-reminder-days", nil, "Days before the grace period ends to publish grace expiring events, can be repeated or comma separated")
 	cmd.Flags().StringVar(&addr, "addr", "127.0.0.1:8080", "HTTP server address")
+	cmd.Flags().StringVar(&authMode, "auth", "", "Web UI authentication: static, oidc or proxy")
+	cmd.Flags().StringArrayVar(&authUsers, "auth-user", nil, "Static user as username:role:bcrypt-hash, can be repeated")
+	cmd.Flags().StringVar(&authDefaultRole, "auth-default-role", "", "Role of oidc and proxy users without an explicit role")
+	cmd.Flags().StringVar(&oidcIssuer, "oidc-issuer", "", "OIDC issuer url")
+	cmd.Flags().StringVar(&oidcClientID, "oidc-client-id", "", "OIDC client id")
+	cmd.Flags().StringVar(&oidcClientSecret, "oidc-client-secret", "", "OIDC client secret")
+	cmd.Flags().StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "OIDC redirect url pointing to the /login route")
+	cmd.Flags().StringArrayVar(&oidcRoles, "oidc-role", nil, "Role of an oidc user as email=role, can be repeated")
+	cmd.Flags().StringVar(&proxyUserHeader, "proxy-user-header", "X-Forwarded-User", "Header containing the username set by the reverse proxy")
+	cmd.Flags().StringVar(&proxyRoleHeader, "proxy-role-header", "", "Header containing the role set by the reverse proxy")
+	cmd.Flags().BoolVar(&trustProxy, "trust-proxy", false, "Trust the X-Forwarded-Proto header of a tls terminating reverse proxy, implied by --auth=proxy")
+	cmd.Flags().BoolVar(&disableJobs, "disable-jobs", false, "Skip the periodic jobs such as usage reporting, set on every replica but one")
+	cmd.Flags().StringVar(&sessionSecret, "session-secret", "", "Secret used to sign web ui sessions")
+	cmd.Flags().StringVar(&inviteSecret, "invite-secret", "", "Secret used to sign subscription invite tokens")
+	cmd.Flags().StringArrayVar(&apiTokens, "api-token", nil, "JSON API bearer token as name:role:token, can be repeated")
+	cmd.AddCommand(hashPasswordCmd)
+}
+
+func getAuthenticator() (cent.Authenticator, error) {
+	switch authMode {
+	case "":
+		return nil, nil
+	case "static":
+		users := make(map[string]cent.StaticUser)
+		for _, u := range authUsers {
+			parts := strings.SplitN(u, ":", 3)
+			if len(parts) != 3 || !cent.Role(parts[1]).Valid() {
+				return nil, fmt.Errorf("invalid user %q expected username:role:hash", u)
+			}
+
+			users[parts[0]] = cent.StaticUser{
+				Role:         cent.Role(parts[1]),
+				PasswordHash: parts[2],
+			}
+		}
+
+		if len(users) == 0 {
+			return nil, errors.New("static authentication requires at least one --auth-user")
+		}
+
+		return &cent.StaticAuth{Users: users}, nil
+	case "oidc":
+		roles := make(map[string]cent.Role)
+		for _, r := range oidcRoles {
+			email, role, found := strings.Cut(r, "=")
+			if !found || !cent.Role(role).Valid() {
+				return nil, fmt.Errorf("invalid oidc role %q expected email=role", r)
+			}
+
+			roles[email] = cent.Role(role)
+		}
+
+		return &cent.OIDCAuth{
+			Issuer:       oidcIssuer,
+			ClientID:     oidcClientID,
+			ClientSecret: getOIDCClientSecret(),
+			RedirectURL:  oidcRedirectURL,
+			Roles:        roles,
+			DefaultRole:  cent.Role(authDefaultRole),
+		}, nil
+	case "proxy":
+		return &cent.ProxyAuth{
+			UserHeader:  proxyUserHeader,
+			RoleHeader:  proxyRoleHeader,
+			DefaultRole: cent.Role(authDefaultRole),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown authentication %q", authMode)
+	}
+}
+
+// getAPITokens parses the api tokens given as flags or as the comma separated API_TOKENS environment variable
+func getAPITokens() ([]cent.APIToken, error) {
+	values := apiTokens
+	if len(values) == 0 {
+		if env := os.Getenv("API_TOKENS"); env != "" {
+			values = strings.Split(env, ",")
+		}
+	}
+
+	var tokens []cent.APIToken
+	for _, v := range values {
+		parts := strings.SplitN(strings.TrimSpace(v), ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" || !cent.Role(parts[1]).Valid() {
+			return nil, fmt.Errorf("invalid api token expected name:role:token")
+		}
+
+		tokens = append(tokens, cent.APIToken{Name: parts[0], Role: cent.Role(parts[1]), Token: parts[2]})
+	}
+
+	if enableAPI && len(tokens) == 0 {
+		return nil, errors.New("--api requires at least one --api-token")
+	}
+
+	return tokens, nil
+}
+
+func getOIDCClientSecret() string {
+	if oidcClientSecret == "" {
+		return os.Getenv("OIDC_CLIENT_SECRET")
+	}
+
+	return oidcClientSecret
+}
+
+func getSessionSecret() string {
+	if sessionSecret == "" {
+		return os.Getenv("SESSION_SECRET")
+	}
+
+	return sessionSecret
+}
+
+func getInviteSecret() string {
+	if inviteSecret == "" {
+		return os.Getenv("INVITE_SECRET")
+	}
+
+	return inviteSecret
 }
 
 func getConnectionString() string {
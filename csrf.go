@@ -0,0 +1,73 @@
+package cent
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/cristosal/cent/templates"
+)
+
+const (
+	csrfCookie = "cent_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfProtect verifies that requests with unsafe methods carry the token stored in the csrf cookie.
+// The token is made available to the templates so that forms can submit it.
+func csrfProtect(s *Sessions, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+			token = c.Value
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if token == "" {
+				b := make([]byte, 32)
+				if _, err := rand.Read(b); err != nil {
+					writeErr(w, err)
+					return
+				}
+
+				token = hex.EncodeToString(b)
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookie,
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   s.secure(r),
+					SameSite: http.SameSiteStrictMode,
+				})
+			}
+		default:
+			submitted := r.Header.Get(csrfHeader)
+			if submitted == "" {
+				submitted = r.PostFormValue(templates.CSRFField)
+			}
+
+			if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) != 1 {
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := templates.WithCSRFToken(r.Context(), token)
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// onlyPost rejects requests that do not use the POST method
+func onlyPost(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h(w, r)
+	}
+}
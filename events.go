@@ -1,19 +1,36 @@
 package cent
 
 const (
+	SubjAnalytics                    = "cent.analytics.summary"
+	SubjAnalyticsRevenue             = "cent.analytics.revenue"
+	SubjAnalyticsRevenueByPlan       = "cent.analytics.revenue.plan"
+	SubjAnalyticsSubscriptions       = "cent.analytics.subscriptions"
+	SubjAnalyticsTrials              = "cent.analytics.trials"
 	SubjCheckout                     = "cent.checkout"
+	SubjCouponAdd                    = "cent.coupon.add"
+	SubjCouponList                   = "cent.coupon.list"
 	SubjCustomerAdd                  = "cent.customer.add"
 	SubjCustomerAdded                = "cent.customer.added"
+	SubjCustomerCardExpiring         = "cent.customer.card_expiring"
 	SubjCustomerGetByEmail           = "cent.customer.get.email"
 	SubjCustomerGetByID              = "cent.customer.get.id"
 	SubjCustomerGetByProviderID      = "cent.customer.get.provider_id"
 	SubjCustomerList                 = "cent.customer.list"
+	SubjCustomerPaymentMethodList    = "cent.customer.payment_method.list"
 	SubjCustomerRemoveByProviderID   = "cent.customer.remove.provider_id"
 	SubjCustomerRemoved              = "cent.customer.removed"
 	SubjCustomerUpdate               = "cent.customer.update"
 	SubjCustomerUpdated              = "cent.customer.updated"
+	SubjEntitlementsCheck            = "cent.entitlements.check"
+	SubjEntitlementsList             = "cent.entitlements.list"
+	SubjPaymentGetByProviderID       = "cent.payment.get.provider_id"
+	SubjPaymentListByCustomerID      = "cent.payment.list.customer_id"
+	SubjPaymentSucceeded             = "cent.payment.succeeded"
+	SubjPortal                       = "cent.portal"
 	SubjPlanAdd                      = "cent.plan.add"
 	SubjPlanAdded                    = "cent.plan.added"
+	SubjPlanEntitlementsList         = "cent.plan.entitlements.list"
+	SubjPlanEntitlementsSet          = "cent.plan.entitlements.set"
 	SubjPlanGetByID                  = "cent.plan.get.id"
 	SubjPlanGetByName                = "cent.plan.get.name"
 	SubjPlanGetByProviderID          = "cent.plan.get.provider_id"
@@ -26,6 +43,8 @@ const (
 	SubjPlanRemoved                  = "cent.plan.removed"
 	SubjPlanUpdate                   = "cent.plan.update"
 	SubjPlanUpdated                  = "cent.plan.updated"
+	SubjPromotionCodeAdd             = "cent.promotion_code.add"
+	SubjPromotionCodeList            = "cent.promotion_code.list"
 	SubjPriceAdd                     = "cent.price.add"
 	SubjPriceAdded                   = "cent.price.added"
 	SubjPriceGetByID                 = "cent.price.get.id"
@@ -33,17 +52,41 @@ const (
 	SubjPriceList                    = "cent.price.list"
 	SubjPriceListByPlanID            = "cent.price.list.plan_id"
 	SubjPriceRemoved                 = "cent.price.removed"
+	SubjPriceUpdate                  = "cent.price.update"
 	SubjPriceUpdated                 = "cent.price.updated"
 	SubjSubscriptionActivated        = "cent.subscription.activated"
 	SubjSubscriptionAdded            = "cent.subscription.added"
+	SubjSubscriptionCancel           = "cent.subscription.cancel"
+	SubjSubscriptionChange           = "cent.subscription.change"
 	SubjSubscriptionDeactivated      = "cent.subscription.deactivated"
+	SubjSubscriptionDiscountApply    = "cent.subscription.discount.apply"
+	SubjSubscriptionDiscountRemove   = "cent.subscription.discount.remove"
 	SubjSubscriptionGetByID          = "cent.subscription.get.id"
 	SubjSubscriptionGetByProviderID  = "cent.subscription.get.provider_id"
+	SubjSubscriptionGraceExpiring    = "cent.subscription.grace_expiring"
+	SubjSubscriptionHistory          = "cent.subscription.history"
+	SubjSubscriptionInviteAccept     = "cent.subscription.invite.accept"
+	SubjSubscriptionInviteAccepted   = "cent.subscription.invite.accepted"
+	SubjSubscriptionInviteAdd        = "cent.subscription.invite.add"
+	SubjSubscriptionInviteAdded      = "cent.subscription.invite.added"
+	SubjSubscriptionInviteExpired    = "cent.subscription.invite.expired"
+	SubjSubscriptionInviteList       = "cent.subscription.invite.list"
+	SubjSubscriptionInviteResend     = "cent.subscription.invite.resend"
+	SubjSubscriptionInviteResent     = "cent.subscription.invite.resent"
+	SubjSubscriptionInviteRevoke     = "cent.subscription.invite.revoke"
+	SubjSubscriptionInviteRevoked    = "cent.subscription.invite.revoked"
+	SubjSubscriptionItemList         = "cent.subscription.item.list"
 	SubjSubscriptionList             = "cent.subscription.list"
+	SubjSubscriptionListActiveAt     = "cent.subscription.list.active_at"
 	SubjSubscriptionListByCustomerID = "cent.subscription.list.customer_id"
 	SubjSubscriptionListByPlanID     = "cent.subscription.list.plan_id"
 	SubjSubscriptionListByUsername   = "cent.subscription.list.username"
+	SubjSubscriptionOwnerTransfer    = "cent.subscription.owner.transfer"
+	SubjSubscriptionPause            = "cent.subscription.pause"
+	SubjSubscriptionPaymentFailed    = "cent.subscription.payment_failed"
 	SubjSubscriptionRemoved          = "cent.subscription.removed"
+	SubjSubscriptionResume           = "cent.subscription.resume"
+	SubjSubscriptionSeats            = "cent.subscription.seats"
 	SubjSubscriptionUpdated          = "cent.subscription.updated"
 	SubjSubscriptionUserAdd          = "cent.subscription.user.add"
 	SubjSubscriptionUserAdded        = "cent.subscription.user.added"
@@ -51,5 +94,9 @@ const (
 	SubjSubscriptionUserList         = "cent.subscription.user.list"
 	SubjSubscriptionUserRemove       = "cent.subscription.user.remove"
 	SubjSubscriptionUserRemoved      = "cent.subscription.user.removed"
+	SubjSubscriptionUserRole         = "cent.subscription.user.role"
+	SubjSubscriptionUserUpdated      = "cent.subscription.user.updated"
 	SubjSync                         = "cent.sync"
+	SubjUsageList                    = "cent.usage.list"
+	SubjUsageRecord                  = "cent.usage.record"
 )
@@ -6,6 +6,8 @@ require (
 	github.com/jackc/pgx/v5 v5.5.0
 	github.com/nats-io/nats.go v1.31.0
 	github.com/spf13/cobra v1.8.0
+	github.com/stripe/stripe-go/v74 v74.30.0
+	golang.org/x/crypto v0.16.0
 )
 
 require (
@@ -17,8 +19,6 @@ require (
 	github.com/nats-io/nkeys v0.4.5 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/stripe/stripe-go/v74 v74.30.0 // indirect
-	golang.org/x/crypto v0.16.0 // indirect
 	golang.org/x/sync v0.5.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
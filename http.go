@@ -5,41 +5,90 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cristosal/cent/templates"
 	"github.com/cristosal/orm"
 
 	"github.com/cristosal/cent/pay"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/stripe/stripe-go/v74"
 )
 
-func handleWebUI(p *pay.StripeProvider, addr string) {
-	http.HandleFunc("/", handleHome())
-	http.HandleFunc("/checkout", handleCheckout(p, addr))
-	http.HandleFunc("/plans", handlePlans(p))
-	http.HandleFunc("/plans/new", handlePlansNew(p))
-	http.HandleFunc("/plans/delete", handlePlansDelete(p))
-	http.HandleFunc("/prices/", handlePrices(p))
-	http.HandleFunc("/prices/new", handlePricesNew(p))
-	http.HandleFunc("/sync", handleSync(p))
-	http.HandleFunc("/customers", handleCustomers(p))
-	http.HandleFunc("/customers/new", handleCustomersNew(p))
-	http.HandleFunc("/subscriptions", handleSubscriptions(p))
-	http.HandleFunc("/subscriptions/users", handleSubscriptionsUsers(p))
-	http.HandleFunc("/subscriptions/users/new", handleSubscriptionsUsersNew(p))
-	http.HandleFunc("/subscriptions/users/delete", handleSubscriptionsUsersDelete(p))
-	http.HandleFunc("/events", handleWebhookEvents(p))
-	http.HandleFunc("/checkout/success", handleCheckoutSuccess())
+// handleWebUI registers the web ui routes. The api reference page is only served when docs is set, as its document is served by the api.
+func handleWebUI(p *pay.StripeProvider, addr string, a *webAuth, docs bool) {
+	route := func(pattern string, read, write Role, h http.HandlerFunc) {
+		if docs {
+			h = withAPIDocs(h)
+		}
+
+		http.HandleFunc(pattern, csrfProtect(a.sessions, a.protect(read, write, h)))
+	}
+
+	http.HandleFunc("/login", csrfProtect(a.sessions, a.handleLogin()))
+	http.HandleFunc("/logout", csrfProtect(a.sessions, onlyPost(a.handleLogout())))
+	http.HandleFunc("/invites/accept", csrfProtect(a.sessions, handleInviteAccept(p)))
+	route("/", RoleViewer, RoleViewer, handleHome(p))
+	route("/checkout", RoleViewer, RoleOperator, handleCheckout(p, addr))
+	route("/plans", RoleViewer, RoleOperator, handlePlans(p))
+	route("/plans/new", RoleViewer, RoleOperator, handlePlansNew(p))
+	route("/plans/edit", RoleViewer, RoleOperator, handlePlansEdit(p))
+	route("/plans/delete", RoleAdmin, RoleAdmin, onlyPost(handlePlansDelete(p)))
+	route("/prices/", RoleViewer, RoleViewer, handlePrices(p))
+	route("/prices/new", RoleViewer, RoleOperator, handlePricesNew(p))
+	route("/prices/edit", RoleViewer, RoleOperator, handlePricesEdit(p))
+	route("/sync", RoleOperator, RoleOperator, onlyPost(handleSync(p)))
+	route("/customers", RoleViewer, RoleViewer, handleCustomers(p))
+	route("/customers/", RoleViewer, RoleViewer, handleCustomerDetail(p))
+	route("/customers/new", RoleViewer, RoleOperator, handleCustomersNew(p))
+	route("/customers/edit", RoleViewer, RoleOperator, handleCustomersEdit(p))
+	route("/customers/delete", RoleAdmin, RoleAdmin, onlyPost(handleCustomersDelete(p)))
+	route("/subscriptions", RoleViewer, RoleViewer, handleSubscriptions(p))
+	route("/subscriptions/cancel", RoleAdmin, RoleAdmin, onlyPost(handleSubscriptionsCancel(p)))
+	route("/subscriptions/pause", RoleOperator, RoleOperator, onlyPost(handleSubscriptionsPause(p)))
+	route("/subscriptions/resume", RoleOperator, RoleOperator, onlyPost(handleSubscriptionsResume(p)))
+	route("/subscriptions/change", RoleOperator, RoleOperator, onlyPost(handleSubscriptionsChange(p)))
+	route("/subscriptions/users", RoleViewer, RoleViewer, handleSubscriptionsUsers(p))
+	route("/subscriptions/users/new", RoleViewer, RoleOperator, handleSubscriptionsUsersNew(p))
+	route("/subscriptions/users/delete", RoleAdmin, RoleAdmin, onlyPost(handleSubscriptionsUsersDelete(p)))
+	route("/subscriptions/users/role", RoleOperator, RoleOperator, onlyPost(handleSubscriptionsUsersRole(p)))
+	route("/subscriptions/invites/new", RoleOperator, RoleOperator, onlyPost(handleSubscriptionsInvitesNew(p)))
+	route("/subscriptions/invites/resend", RoleOperator, RoleOperator, onlyPost(handleSubscriptionsInvitesResend(p)))
+	route("/subscriptions/invites/revoke", RoleOperator, RoleOperator, onlyPost(handleSubscriptionsInvitesRevoke(p)))
+	route("/subscriptions/discount", RoleOperator, RoleOperator, onlyPost(handleSubscriptionsDiscount(p)))
+	route("/subscriptions/discount/remove", RoleOperator, RoleOperator, onlyPost(handleSubscriptionsDiscountRemove(p)))
+	route("/coupons", RoleViewer, RoleViewer, handleCoupons(p))
+	route("/coupons/new", RoleViewer, RoleOperator, handleCouponsNew(p))
+	route("/coupons/codes/new", RoleOperator, RoleOperator, onlyPost(handlePromotionCodesNew(p)))
+	route("/events", RoleViewer, RoleViewer, handleWebhookEvents(p))
+	route("/checkout/success", RoleViewer, RoleViewer, handleCheckoutSuccess())
+	if docs {
+		route("/api/docs", RoleViewer, RoleViewer, handleAPIDocs())
+	}
+}
+
+// withAPIDocs links the api reference page in the layout
+func withAPIDocs(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(templates.WithAPIDocs(r.Context())))
+	}
+}
+
+func handleAPIDocs() http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		return templates.APIDocs(OpenAPIPath).Render(r.Context(), w)
+	})
 }
 
 func handleSubscriptionsUsersDelete(p *pay.StripeProvider) http.HandlerFunc {
 	return wrap(func(w http.ResponseWriter, r *http.Request) error {
 		var (
-			q        = r.URL.Query()
-			username = q.Get("username")
-			s        = q.Get("s")
+			username = r.PostFormValue("username")
+			s        = r.PostFormValue("s")
 		)
 
 		subID, err := strconv.ParseInt(s, 10, 64)
@@ -50,6 +99,7 @@ func handleSubscriptionsUsersDelete(p *pay.StripeProvider) http.HandlerFunc {
 		if err := p.RemoveSubscriptionUser(&pay.SubscriptionUser{
 			SubscriptionID: subID,
 			Username:       username,
+			System:         true,
 		}); err != nil {
 			return err
 		}
@@ -79,6 +129,8 @@ func handleSubscriptionsUsersNew(p *pay.StripeProvider) http.HandlerFunc {
 			if err := p.AddSubscriptionUser(&pay.SubscriptionUser{
 				SubscriptionID: subID,
 				Username:       username,
+				Role:           r.FormValue("role"),
+				System:         true,
 			}); err != nil {
 				return err
 			}
@@ -104,20 +156,134 @@ func handleSubscriptionsUsers(p *pay.StripeProvider) http.HandlerFunc {
 			return err
 		}
 
-		usernames, err := p.ListUsernames(subID)
-		if errors.Is(err, orm.ErrNotFound) {
-			usernames = []string{}
-			err = nil
+		users, err := p.ListSubscriptionUsers(subID)
+		if err != nil {
+			return err
 		}
 
+		seats, err := p.GetSeats(subID)
 		if err != nil {
 			return err
 		}
 
-		return templates.SubscriptionUsers(subID, usernames).Render(r.Context(), w)
+		invites, err := p.ListSubscriptionInvites(subID)
+		if err != nil {
+			return err
+		}
+
+		return templates.SubscriptionUsers(subID, users, *seats, invites).Render(r.Context(), w)
+	})
+}
+
+func handleSubscriptionsUsersRole(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		subID, err := strconv.ParseInt(r.PostFormValue("s"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if err := p.SetSubscriptionUserRole(&pay.SubscriptionUser{
+			SubscriptionID: subID,
+			Username:       r.PostFormValue("username"),
+			Role:           r.PostFormValue("role"),
+			System:         true,
+		}); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/subscriptions/users?s=%d", subID), http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handleSubscriptionsInvitesNew(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		subID, err := strconv.ParseInt(r.PostFormValue("s"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if err := p.AddSubscriptionInvite(&pay.SubscriptionInvite{
+			SubscriptionID: subID,
+			Email:          r.PostFormValue("email"),
+			InvitedBy:      templates.Username(r.Context()),
+		}); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/subscriptions/users?s=%d", subID), http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handleSubscriptionsInvitesResend(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		inv, err := p.ResendSubscriptionInvite(id)
+		if err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/subscriptions/users?s=%d", inv.SubscriptionID), http.StatusSeeOther)
+		return nil
 	})
 }
 
+func handleSubscriptionsInvitesRevoke(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		inv, err := p.RevokeSubscriptionInvite(id)
+		if err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/subscriptions/users?s=%d", inv.SubscriptionID), http.StatusSeeOther)
+		return nil
+	})
+}
+
+// handleInviteAccept serves the link sent to invited users. It does not require a login as the token grants the seat.
+// Opening the link only shows the invite so that mail scanners following it do not accept it.
+func handleInviteAccept(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		token := r.FormValue("token")
+		inv, err := p.GetSubscriptionInviteByToken(token)
+		if err == nil && r.Method == http.MethodPost {
+			inv, err = p.AcceptSubscriptionInvite(token, "")
+		}
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return templates.InviteAccept(nil, token, inviteErrorMessage(err)).Render(r.Context(), w)
+		}
+
+		return templates.InviteAccept(inv, token, "").Render(r.Context(), w)
+	})
+}
+
+// inviteErrorMessage describes why an invite can not be accepted
+func inviteErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, pay.ErrInviteExpired):
+		return "This invite has expired, ask for a new one"
+	case errors.Is(err, pay.ErrInviteNotPending), errors.Is(err, pay.ErrInvalidInviteToken):
+		return "This invite is no longer valid"
+	case errors.Is(err, pay.ErrSeatLimitReached):
+		return "There are no free seats left on this subscription"
+	}
+
+	log.Printf("ERROR: %v", err)
+	return "Something went wrong while accepting the invite, please try again"
+}
+
 func handleCheckoutSuccess() http.HandlerFunc {
 	return wrap(func(w http.ResponseWriter, r *http.Request) error {
 		return templates.CheckoutSuccess().Render(r.Context(), w)
@@ -130,7 +296,7 @@ func handleCheckout(p *pay.StripeProvider, addr string) http.HandlerFunc {
 		case http.MethodPost:
 			var (
 				formCustomerID = r.FormValue("customer_id")
-				formPriceID    = r.FormValue("customer_id")
+				formPriceID    = r.FormValue("price_id")
 			)
 
 			customerID, err := strconv.ParseInt(formCustomerID, 10, 64)
@@ -143,10 +309,18 @@ func handleCheckout(p *pay.StripeProvider, addr string) http.HandlerFunc {
 				return err
 			}
 
+			quantity, err := strconv.ParseInt(r.FormValue("quantity"), 10, 64)
+			if err != nil {
+				return err
+			}
+
 			url, err := p.Checkout(&pay.CheckoutRequest{
-				CustomerID:  customerID,
-				PriceID:     priceID,
-				RedirectURL: "http://" + addr + "/checkout/success",
+				CustomerID:          customerID,
+				PriceID:             priceID,
+				Quantity:            quantity,
+				RedirectURL:         "http://" + addr + "/checkout/success",
+				CancelURL:           "http://" + addr + "/checkout",
+				AllowPromotionCodes: r.FormValue("allow_promotion_codes") == "on",
 			})
 			if err != nil {
 				return err
@@ -198,7 +372,244 @@ func handleSubscriptions(p *pay.StripeProvider) http.HandlerFunc {
 			}
 		}
 
-		return templates.SubscriptionsIndex(subs, username).Render(r.Context(), w)
+		prices, err := p.ListAllPrices()
+		if err != nil {
+			return err
+		}
+
+		coupons, err := p.ListCoupons()
+		if err != nil {
+			return err
+		}
+
+		return templates.SubscriptionsIndex(subs, username, prices, coupons).Render(r.Context(), w)
+	})
+}
+
+func handleSubscriptionsCancel(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		subID, err := strconv.ParseInt(r.PostFormValue("s"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if err := p.CancelSubscription(&pay.CancelSubscriptionRequest{
+			SubscriptionID: subID,
+			AtPeriodEnd:    r.PostFormValue("at_period_end") == "on",
+		}); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/subscriptions", http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handleSubscriptionsPause(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		subID, err := strconv.ParseInt(r.PostFormValue("s"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if err := p.PauseSubscription(subID); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/subscriptions", http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handleSubscriptionsResume(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		subID, err := strconv.ParseInt(r.PostFormValue("s"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if err := p.ResumeSubscription(subID); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/subscriptions", http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handleSubscriptionsChange(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		subID, err := strconv.ParseInt(r.PostFormValue("s"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		priceID, err := strconv.ParseInt(r.PostFormValue("price_id"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if err := p.ChangeSubscriptionPrice(&pay.ChangePriceRequest{
+			SubscriptionID: subID,
+			PriceID:        priceID,
+			Proration:      r.PostFormValue("proration"),
+		}); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/subscriptions", http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handleSubscriptionsDiscount(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		subID, err := strconv.ParseInt(r.PostFormValue("s"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		couponID, err := strconv.ParseInt(r.PostFormValue("coupon_id"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if err := p.ApplySubscriptionDiscount(&pay.DiscountRequest{
+			SubscriptionID: subID,
+			CouponID:       couponID,
+		}); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/subscriptions", http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handleSubscriptionsDiscountRemove(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		subID, err := strconv.ParseInt(r.PostFormValue("s"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if err := p.RemoveSubscriptionDiscount(subID); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/subscriptions", http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handleCoupons(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		coupons, err := p.ListCoupons()
+		if err != nil {
+			return err
+		}
+
+		codes, err := p.ListPromotionCodes()
+		if err != nil {
+			return err
+		}
+
+		return templates.CouponsIndex(coupons, codes).Render(r.Context(), w)
+	})
+}
+
+func handleCouponsNew(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		c := pay.Coupon{Duration: pay.CouponOnce}
+		if r.Method != http.MethodPost {
+			return templates.CouponsNew(c, nil).Render(r.Context(), w)
+		}
+
+		errs := make(templates.FormErrors)
+		c.Name = strings.TrimSpace(r.PostFormValue("name"))
+		c.Duration = r.PostFormValue("duration")
+		c.Currency = strings.TrimSpace(r.PostFormValue("currency"))
+
+		if v := r.PostFormValue("percent_off"); v != "" {
+			percent, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs["percent_off"] = "Percent off is not a number"
+			}
+
+			c.PercentOff = percent
+		}
+
+		if v := r.PostFormValue("amount_off"); v != "" {
+			amount, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				errs["amount_off"] = "Amount off is not a whole number"
+			}
+
+			c.AmountOff = amount
+		}
+
+		c.DurationInMonths, _ = strconv.ParseInt(r.PostFormValue("duration_in_months"), 10, 64)
+		c.MaxRedemptions, _ = strconv.ParseInt(r.PostFormValue("max_redemptions"), 10, 64)
+
+		if v := r.PostFormValue("redeem_by"); v != "" {
+			redeemBy, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				errs["redeem_by"] = "Redeem by is not a date"
+			}
+
+			c.RedeemBy = &redeemBy
+		}
+
+		if !errs.Has() {
+			switch err := p.AddCoupon(&c); {
+			case errors.Is(err, pay.ErrInvalidCouponDiscount):
+				errs["percent_off"] = "Enter a percent off between 0 and 100, or an amount off with a currency"
+			case errors.Is(err, pay.ErrInvalidCouponDuration):
+				errs["duration_in_months"] = "Repeating coupons need a number of months"
+			case err != nil:
+				errs[""] = formErrorMessage(err)
+			}
+		}
+
+		if errs.Has() {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return templates.CouponsNew(c, errs).Render(r.Context(), w)
+		}
+
+		http.Redirect(w, r, "/coupons", http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handlePromotionCodesNew(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		couponID, err := strconv.ParseInt(r.PostFormValue("coupon_id"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		pc := pay.PromotionCode{
+			CouponID:             couponID,
+			Code:                 strings.TrimSpace(r.PostFormValue("code")),
+			FirstTimeTransaction: r.PostFormValue("first_time_transaction") == "on",
+		}
+
+		pc.MaxRedemptions, _ = strconv.ParseInt(r.PostFormValue("max_redemptions"), 10, 64)
+		if v := r.PostFormValue("expires_at"); v != "" {
+			expiresAt, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return err
+			}
+
+			pc.ExpiresAt = &expiresAt
+		}
+
+		if err := p.AddPromotionCode(&pc); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/coupons", http.StatusSeeOther)
+		return nil
 	})
 }
 
@@ -223,61 +634,205 @@ func handleSync(p *pay.StripeProvider) http.HandlerFunc {
 	})
 }
 
-func handleHome() http.HandlerFunc {
+func handleHome(p *pay.StripeProvider) http.HandlerFunc {
 	return wrap(func(w http.ResponseWriter, r *http.Request) error {
-		return templates.Home().Render(r.Context(), w)
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return nil
+		}
+
+		req := pay.AnalyticsRequest{Interval: r.URL.Query().Get("interval")}
+		switch req.Interval {
+		case pay.IntervalDay:
+			req.Since = time.Now().AddDate(0, 0, -30)
+		case pay.IntervalWeek:
+			req.Since = time.Now().AddDate(0, 0, -7*26)
+		default:
+			req.Interval = pay.IntervalMonth
+		}
+
+		a, err := p.GetAnalytics(&req)
+		if err != nil {
+			return err
+		}
+
+		return templates.Home(a, req.Interval).Render(r.Context(), w)
 	})
 }
 
 func handlePlansNew(p *pay.StripeProvider) http.HandlerFunc {
 	return wrap(func(w http.ResponseWriter, r *http.Request) error {
 		if r.Method == http.MethodPost {
-			if err := r.ParseForm(); err != nil {
-				return fmt.Errorf("error while parsing form: %v", err)
-			}
+			return addPlanForm(p, w, r)
+		}
 
-			name := r.Form.Get("name")
-			desc := r.Form.Get("description")
-			active := r.Form.Get("active") == "on"
+		return templates.PlansNew(pay.Plan{}, nil).Render(r.Context(), w)
+	})
+}
 
-			err := p.AddPlan(&pay.Plan{
-				Name:        name,
-				Description: desc,
-				Active:      active,
-			})
-			if err != nil {
-				return fmt.Errorf("error while adding plan: %v", err)
-			}
+// addPlanForm adds the plan submitted by the new plan form, rendering the form again when it is invalid
+func addPlanForm(p *pay.StripeProvider, w http.ResponseWriter, r *http.Request) error {
+	pl := pay.Plan{
+		Name:        strings.TrimSpace(r.PostFormValue("name")),
+		Description: strings.TrimSpace(r.PostFormValue("description")),
+		Active:      r.PostFormValue("active") == "on",
+	}
 
-			http.Redirect(w, r, "/plans", http.StatusSeeOther)
-			return nil
+	errs := make(templates.FormErrors)
+	if pl.Name == "" {
+		errs["name"] = "Name is required"
+	}
+
+	n, ok := parseMaxSeats(r.PostFormValue("max_seats"))
+	if !ok {
+		errs["max_seats"] = "Max seats must be zero or more"
+	}
+
+	pl.MaxSeats = n
+	if !errs.Has() {
+		if err := p.AddPlan(&pl); err != nil {
+			errs[""] = formErrorMessage(err)
 		}
+	}
 
-		return templates.PlansNew().Render(r.Context(), w)
-	})
+	if errs.Has() {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return templates.PlansNew(pl, errs).Render(r.Context(), w)
+	}
+
+	http.Redirect(w, r, "/plans", http.StatusSeeOther)
+	return nil
 }
 
-func handlePlans(p *pay.StripeProvider) http.HandlerFunc {
+// parseMaxSeats parses the max seats of a plan form, where an empty value means unlimited seats
+func parseMaxSeats(v string) (int64, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, true
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func handlePlansEdit(p *pay.StripeProvider) http.HandlerFunc {
 	return wrap(func(w http.ResponseWriter, r *http.Request) error {
-		if r.Method == http.MethodPost {
-			if err := r.ParseForm(); err != nil {
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		pl, err := p.GetPlanByID(id)
+		if err != nil {
+			return err
+		}
+
+		if r.Method != http.MethodPost {
+			ents, err := p.ListPlanEntitlements(pl.ID)
+			if err != nil {
 				return err
 			}
 
-			name := r.Form.Get("name")
-			desc := r.Form.Get("description")
-			active := r.Form.Get("active") == "on"
-			err := p.AddPlan(&pay.Plan{
-				Name:        name,
-				Description: desc,
-				Active:      active,
-			})
+			return templates.PlansEdit(*pl, formatEntitlements(ents), nil).Render(r.Context(), w)
+		}
+
+		pl.Name = strings.TrimSpace(r.PostFormValue("name"))
+		pl.Description = strings.TrimSpace(r.PostFormValue("description"))
+		pl.Active = r.PostFormValue("active") == "on"
+
+		errs := make(templates.FormErrors)
+		if pl.Name == "" {
+			errs["name"] = "Name is required"
+		}
+
+		n, ok := parseMaxSeats(r.PostFormValue("max_seats"))
+		if !ok {
+			errs["max_seats"] = "Max seats must be zero or more"
+		}
+
+		pl.MaxSeats = n
+
+		entitlements := r.PostFormValue("entitlements")
+		ents, err := parseEntitlements(entitlements)
+		if err != nil {
+			errs["entitlements"] = "Limits must be numbers, as in projects=10"
+		}
+
+		if !errs.Has() {
+			err := p.SetPlanEntitlements(pl.ID, ents)
+			switch {
+			case errors.Is(err, pay.ErrDuplicateFeature), errors.Is(err, pay.ErrInvalidLimit):
+				errs["entitlements"] = "Features can only be listed once and limits must be zero or more"
+			case err != nil:
+				errs[""] = formErrorMessage(err)
+			}
+		}
+
+		if !errs.Has() {
+			if err := p.UpdatePlan(pl); err != nil {
+				errs[""] = formErrorMessage(err)
+			}
+		}
+
+		if errs.Has() {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return templates.PlansEdit(*pl, entitlements, errs).Render(r.Context(), w)
+		}
+
+		http.Redirect(w, r, "/plans", http.StatusSeeOther)
+		return nil
+	})
+}
+
+// formatEntitlements writes one feature per line, followed by =limit when it is limited
+func formatEntitlements(ents []pay.Entitlement) string {
+	var b strings.Builder
+	for _, e := range ents {
+		b.WriteString(e.Feature)
+		if e.Limit != nil {
+			fmt.Fprintf(&b, "=%d", *e.Limit)
+		}
+
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// parseEntitlements reads the entitlements written by formatEntitlements
+func parseEntitlements(text string) ([]pay.Entitlement, error) {
+	var ents []pay.Entitlement
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		feature, limit, limited := strings.Cut(line, "=")
+		e := pay.Entitlement{Feature: strings.TrimSpace(feature)}
+		if limited {
+			n, err := strconv.ParseInt(strings.TrimSpace(limit), 10, 64)
 			if err != nil {
-				return err
+				return nil, fmt.Errorf("limit of %s is not a number", e.Feature)
 			}
 
-			http.Redirect(w, r, "/plans", http.StatusSeeOther)
-			return nil
+			e.Limit = &n
+		}
+
+		ents = append(ents, e)
+	}
+
+	return ents, nil
+}
+
+func handlePlans(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method == http.MethodPost {
+			return addPlanForm(p, w, r)
 		}
 
 		plans, err := p.ListActivePlans()
@@ -291,8 +846,7 @@ func handlePlans(p *pay.StripeProvider) http.HandlerFunc {
 
 func handlePlansDelete(p *pay.StripeProvider) http.HandlerFunc {
 	return wrap(func(w http.ResponseWriter, r *http.Request) error {
-		idQuery := r.URL.Query().Get("id")
-		id, err := strconv.ParseInt(idQuery, 10, 64)
+		id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
 		if err != nil {
 			return err
 		}
@@ -322,6 +876,88 @@ func handlePrices(p *pay.StripeProvider) http.HandlerFunc {
 	})
 }
 
+func handlePricesEdit(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		pr, err := p.GetPriceByID(id)
+		if err != nil {
+			return err
+		}
+
+		if r.Method != http.MethodPost {
+			return templates.PricesEdit(*pr, formatMetadata(pr.Metadata), nil).Render(r.Context(), w)
+		}
+
+		var (
+			errs     = make(templates.FormErrors)
+			metadata = r.PostFormValue("metadata")
+		)
+
+		pr.Nickname = strings.TrimSpace(r.PostFormValue("nickname"))
+		pr.Active = r.PostFormValue("active") == "on"
+		pr.Metadata, err = parseMetadata(metadata)
+		if err != nil {
+			errs["metadata"] = err.Error()
+		}
+
+		if !errs.Has() {
+			if err := p.UpdatePrice(pr); err != nil {
+				errs[""] = formErrorMessage(err)
+			}
+		}
+
+		if errs.Has() {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return templates.PricesEdit(*pr, metadata, errs).Render(r.Context(), w)
+		}
+
+		http.Redirect(w, r, "/prices", http.StatusSeeOther)
+		return nil
+	})
+}
+
+// parseMetadata parses metadata entered as one key=value pair per line
+func parseMetadata(s string) (pay.Metadata, error) {
+	m := make(pay.Metadata)
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		k, v, found := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !found || k == "" {
+			return nil, fmt.Errorf("line %d must be in the form key=value", i+1)
+		}
+
+		m[k] = strings.TrimSpace(v)
+	}
+
+	return m, nil
+}
+
+// formatMetadata formats metadata as one key=value pair per line, sorted by key
+func formatMetadata(m pay.Metadata) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, m[k])
+	}
+
+	return b.String()
+}
+
 func handlePricesNew(p *pay.StripeProvider) http.HandlerFunc {
 	return wrap(func(w http.ResponseWriter, r *http.Request) error {
 		switch r.Method {
@@ -411,6 +1047,148 @@ func handleCustomersNew(p *pay.StripeProvider) http.HandlerFunc {
 	})
 }
 
+func handleCustomerDetail(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/customers/"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return nil
+		}
+
+		c, err := p.GetCustomerByID(id)
+		if errors.Is(err, orm.ErrNotFound) {
+			http.NotFound(w, r)
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		subs, err := p.ListSubscriptionsByCustomerID(c.ID)
+		if err != nil {
+			return err
+		}
+
+		var customerSubs []templates.CustomerSubscription
+		for _, s := range subs {
+			pr, err := p.GetPriceByID(s.PriceID)
+			if err != nil {
+				return err
+			}
+
+			pl, err := p.GetPlanByID(pr.PlanID)
+			if err != nil {
+				return err
+			}
+
+			usernames, err := p.ListUsernames(s.ID)
+			if err != nil && !errors.Is(err, orm.ErrNotFound) {
+				return err
+			}
+
+			customerSubs = append(customerSubs, templates.CustomerSubscription{
+				Subscription: s,
+				Plan:         *pl,
+				Price:        *pr,
+				Usernames:    usernames,
+			})
+		}
+
+		invoices, err := p.ListInvoicesByCustomerID(c.ID)
+		if err != nil {
+			return err
+		}
+
+		payments, err := p.ListPaymentsByCustomerID(c.ID)
+		if err != nil {
+			return err
+		}
+
+		methods, err := p.ListPaymentMethodsByCustomerID(c.ID)
+		if err != nil {
+			return err
+		}
+
+		events, err := p.ListWebhookEventsByProviderID(c.ProviderID)
+		if err != nil {
+			return err
+		}
+
+		prices, err := p.ListAllPrices()
+		if err != nil {
+			return err
+		}
+
+		return templates.CustomerDetail(*c, customerSubs, invoices, payments, methods, events, prices).Render(r.Context(), w)
+	})
+}
+
+func handleCustomersEdit(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		c, err := p.GetCustomerByID(id)
+		if err != nil {
+			return err
+		}
+
+		if r.Method != http.MethodPost {
+			return templates.CustomersEdit(*c, nil).Render(r.Context(), w)
+		}
+
+		c.Name = strings.TrimSpace(r.PostFormValue("name"))
+		c.Email = strings.TrimSpace(r.PostFormValue("email"))
+
+		errs := make(templates.FormErrors)
+		if c.Name == "" {
+			errs["name"] = "Name is required"
+		}
+
+		if _, err := mail.ParseAddress(c.Email); err != nil {
+			errs["email"] = "Email is not valid"
+		}
+
+		if !errs.Has() {
+			if err := p.UpdateCustomer(c); err != nil {
+				errs[""] = formErrorMessage(err)
+			}
+		}
+
+		if errs.Has() {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return templates.CustomersEdit(*c, errs).Render(r.Context(), w)
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/customers/%d", c.ID), http.StatusSeeOther)
+		return nil
+	})
+}
+
+func handleCustomersDelete(p *pay.StripeProvider) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		c, err := p.GetCustomerByID(id)
+		if err != nil {
+			return err
+		}
+
+		if err := p.RemoveCustomerByProviderID(c.ProviderID); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/customers", http.StatusSeeOther)
+		return nil
+	})
+}
+
 func handleCustomers(p *pay.StripeProvider) http.HandlerFunc {
 	return wrap(func(w http.ResponseWriter, r *http.Request) error {
 		customers, err := p.ListAllCustomers()
@@ -422,6 +1200,18 @@ func handleCustomers(p *pay.StripeProvider) http.HandlerFunc {
 	})
 }
 
+// formErrorMessage returns the message shown on a form when saving fails.
+// Stripe errors carry a message meant for users, other errors are logged and replaced with a generic message
+func formErrorMessage(err error) string {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Msg != "" {
+		return stripeErr.Msg
+	}
+
+	log.Printf("ERROR: %v", err)
+	return "Something went wrong while saving, please try again"
+}
+
 func writeErr(w http.ResponseWriter, err error) {
 	log.Printf("ERROR: %v", err)
 	w.WriteHeader(500)
@@ -0,0 +1,78 @@
+package cent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cristosal/cent/pay"
+)
+
+func TestParseMaxSeats(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   int64
+		wantOK bool
+	}{
+		{"", 0, true},
+		{"  ", 0, true},
+		{"0", 0, true},
+		{"5", 5, true},
+		{" 12 ", 12, true},
+		{"-1", 0, false},
+		{"ten", 0, false},
+		{"1.5", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseMaxSeats(tt.value)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseMaxSeats(%q) = %d, %v, want %d, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseEntitlements(t *testing.T) {
+	ten := int64(10)
+	tests := []struct {
+		name    string
+		text    string
+		want    []pay.Entitlement
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"enabled feature", "sso", []pay.Entitlement{{Feature: "sso"}}, false},
+		{"limited feature", " projects = 10 ", []pay.Entitlement{{Feature: "projects", Limit: &ten}}, false},
+		{"blank lines", "\nsso\r\n\nprojects=10\n", []pay.Entitlement{{Feature: "sso"}, {Feature: "projects", Limit: &ten}}, false},
+		{"invalid limit", "projects=many", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEntitlements(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEntitlements() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseEntitlements() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatEntitlements(t *testing.T) {
+	ten := int64(10)
+	ents := []pay.Entitlement{{Feature: "projects", Limit: &ten}, {Feature: "sso"}}
+
+	text := formatEntitlements(ents)
+	if text != "projects=10\nsso\n" {
+		t.Fatalf("formatEntitlements() = %q", text)
+	}
+
+	parsed, err := parseEntitlements(text)
+	if err != nil || !reflect.DeepEqual(parsed, ents) {
+		t.Errorf("parseEntitlements(formatEntitlements()) = %+v, %v, want %+v", parsed, err, ents)
+	}
+}
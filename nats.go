@@ -1,18 +1,43 @@
 package cent
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/cristosal/cent/pay"
 	"github.com/nats-io/nats.go"
 )
 
+// HeaderIdempotencyKey is the NATS header in which clients pass the idempotency key of a request
+const HeaderIdempotencyKey = "Idempotency-Key"
+
 var ErrBadRequest = errors.New("bad request")
 
+// idempotentSubjects are the subjects which honor the idempotency key header.
+// Repeat requests with the same key are answered with the stored response.
+var idempotentSubjects = map[string]bool{
+	SubjCheckout:                   true,
+	SubjCouponAdd:                  true,
+	SubjCustomerAdd:                true,
+	SubjPlanAdd:                    true,
+	SubjPriceAdd:                   true,
+	SubjPromotionCodeAdd:           true,
+	SubjSubscriptionCancel:         true,
+	SubjSubscriptionChange:         true,
+	SubjSubscriptionDiscountApply:  true,
+	SubjSubscriptionDiscountRemove: true,
+	SubjSubscriptionPause:          true,
+	SubjSubscriptionResume:         true,
+	SubjSubscriptionInviteAccept:   true,
+	SubjSubscriptionUserAdd:        true,
+}
+
 type Server struct {
 	nc       *nats.Conn
 	js       nats.JetStreamContext
@@ -25,8 +50,14 @@ type Config struct {
 	Queue           string
 	WebhookEndpoint string
 	EnableWebUI     bool
+	EnableAPI       bool
 	Provider        *pay.StripeProvider
 	HttpAddr        string
+	Auth            Authenticator // authenticates web ui users, the web ui is open to everyone when nil
+	SessionSecret   string        // signs web ui session cookies, a random secret is used when empty
+	APITokens       []APIToken    // bearer tokens accepted by the json api, at least one is required when the api is enabled
+	TrustProxy      bool          // trust the X-Forwarded-Proto header of a tls terminating reverse proxy
+	DisableJobs     bool          // skip the periodic jobs, for every replica but one when several instances run
 }
 
 func (cfg *Config) setDefaults() {
@@ -52,6 +83,10 @@ func (s *Server) Listen() error {
 		return fmt.Errorf("provider is required")
 	}
 
+	if s.cfg.EnableAPI && len(s.cfg.APITokens) == 0 {
+		return fmt.Errorf("api requires at least one api token")
+	}
+
 	nc, err := nats.Connect(s.cfg.NatsURL)
 	if err != nil {
 		return fmt.Errorf("error connecting to nats: %w", err)
@@ -67,6 +102,13 @@ func (s *Server) Listen() error {
 
 	s.forwardProviderEvents()
 
+	// the jobs stop once the server is no longer listening
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !s.cfg.DisableJobs {
+		go s.runJobs(ctx)
+	}
+
 	if err := s.registerNATSHandlers(); err != nil {
 		return err
 	}
@@ -87,21 +129,47 @@ func New(cfg *Config) *Server {
 
 func (s *Server) registerHTTPHandlers() {
 	http.HandleFunc(s.cfg.WebhookEndpoint, s.cfg.Provider.Webhook())
+	if s.cfg.EnableAPI {
+		handleAPI(s.cfg.Provider, &apiAuth{tokens: s.cfg.APITokens})
+	}
+
 	if s.cfg.EnableWebUI {
-		handleWebUI(s.cfg.Provider, s.cfg.HttpAddr)
+		if s.cfg.Auth == nil {
+			log.Printf("WARNING: web ui authentication is disabled, do not expose %s publicly", s.cfg.HttpAddr)
+		}
+
+		sessions := NewSessions(s.cfg.SessionSecret, 0)
+		sessions.TrustProxy(s.cfg.TrustProxy)
+		handleWebUI(s.cfg.Provider, s.cfg.HttpAddr, &webAuth{
+			auth:     s.cfg.Auth,
+			sessions: sessions,
+		}, s.cfg.EnableAPI)
 	}
 }
 
 func (s *Server) registerNATSHandlers() error {
 	submap := map[string]natsHandler{
+		SubjAnalytics:                    s.handleGetAnalytics(),
+		SubjAnalyticsRevenue:             s.handleListRevenue(),
+		SubjAnalyticsRevenueByPlan:       s.handleListRevenueByPlan(),
+		SubjAnalyticsSubscriptions:       s.handleListSubscriptionPeriods(),
+		SubjAnalyticsTrials:              s.handleGetTrialConversion(),
 		SubjCheckout:                     s.handleCheckout(),
+		SubjCouponAdd:                    s.handleAddCoupon(),
+		SubjCouponList:                   s.handleListCoupons(),
+		SubjEntitlementsCheck:            s.handleCheckEntitlement(),
+		SubjEntitlementsList:             s.handleListEntitlementsByUsername(),
 		SubjCustomerAdd:                  s.handleAddCustomer(),
 		SubjCustomerGetByEmail:           s.handleGetCustomerByEmail(),
 		SubjCustomerGetByID:              s.handleGetCustomerByID(),
 		SubjCustomerGetByProviderID:      s.handleGetCustomerByProvider(),
 		SubjCustomerList:                 s.handleListCustomers(),
+		SubjCustomerPaymentMethodList:    s.handleListPaymentMethods(),
 		SubjCustomerRemoveByProviderID:   s.handleRemoveCustomerByProviderID(),
 		SubjCustomerUpdate:               s.handleUpdateCustomer(),
+		SubjPaymentGetByProviderID:       s.handleGetPaymentByProviderID(),
+		SubjPaymentListByCustomerID:      s.handleListPaymentsByCustomerID(),
+		SubjPortal:                       s.handlePortal(),
 		SubjPlanAdd:                      s.handleAddPlan(),
 		SubjPlanGetByID:                  s.handleGetPlanByID(),
 		SubjPlanGetByName:                s.handleGetPlanByName(),
@@ -111,24 +179,48 @@ func (s *Server) registerNATSHandlers() error {
 		SubjPlanList:                     s.handleListPlans(),
 		SubjPlanListActive:               s.handleListActivePlans(),
 		SubjPlanListByUsername:           s.handleGetPlansByUsername(),
+		SubjPlanEntitlementsList:         s.handleListPlanEntitlements(),
+		SubjPlanEntitlementsSet:          s.handleSetPlanEntitlements(),
 		SubjPlanRemoveByProviderID:       s.handleRemovePlanByProviderID(),
 		SubjPlanUpdate:                   s.handleUpdatePlan(),
 		SubjPriceAdd:                     s.handleAddPrice(),
+		SubjPromotionCodeAdd:             s.handleAddPromotionCode(),
+		SubjPromotionCodeList:            s.handleListPromotionCodes(),
 		SubjPriceGetByID:                 s.handleGetPriceByID(),
 		SubjPriceGetByProviderID:         s.handleGetPriceByProviderID(),
 		SubjPriceList:                    s.handleListPrices(),
 		SubjPriceListByPlanID:            s.handleListPricesByPlanID(),
+		SubjPriceUpdate:                  s.handleUpdatePrice(),
+		SubjSubscriptionCancel:           s.handleCancelSubscription(),
+		SubjSubscriptionChange:           s.handleChangeSubscriptionPrice(),
+		SubjSubscriptionDiscountApply:    s.handleApplySubscriptionDiscount(),
+		SubjSubscriptionDiscountRemove:   s.handleRemoveSubscriptionDiscount(),
 		SubjSubscriptionGetByID:          s.handleGetSubscriptionByID(),
 		SubjSubscriptionGetByProviderID:  s.handleGetSubscriptionByProviderID(),
+		SubjSubscriptionHistory:          s.handleListSubscriptionHistory(),
+		SubjSubscriptionInviteAccept:     s.handleAcceptSubscriptionInvite(),
+		SubjSubscriptionInviteAdd:        s.handleAddSubscriptionInvite(),
+		SubjSubscriptionInviteList:       s.handleListSubscriptionInvites(),
+		SubjSubscriptionInviteResend:     s.handleResendSubscriptionInvite(),
+		SubjSubscriptionInviteRevoke:     s.handleRevokeSubscriptionInvite(),
+		SubjSubscriptionItemList:         s.handleListSubscriptionItems(),
 		SubjSubscriptionList:             s.handleListSubscriptions(),
+		SubjSubscriptionListActiveAt:     s.handleListSubscriptionsActiveAt(),
 		SubjSubscriptionListByCustomerID: s.handleListSubscriptionsByCustomerID(),
 		SubjSubscriptionListByPlanID:     s.handleListSubscriptionsByPlanID(),
 		SubjSubscriptionListByUsername:   s.handleListSubscriptionsByUsername(),
+		SubjSubscriptionPause:            s.handlePauseSubscription(),
+		SubjSubscriptionResume:           s.handleResumeSubscription(),
+		SubjSubscriptionSeats:            s.handleGetSubscriptionSeats(),
 		SubjSubscriptionUserAdd:          s.handleAddSubscriptionUser(),
 		SubjSubscriptionUserCount:        s.handleCountSubscriptionUsers(),
 		SubjSubscriptionUserList:         s.handleListSubscriptionUsers(),
 		SubjSubscriptionUserRemove:       s.handleRemoveSubscriptionUser(),
+		SubjSubscriptionUserRole:         s.handleSetSubscriptionUserRole(),
+		SubjSubscriptionOwnerTransfer:    s.handleTransferSubscriptionOwnership(),
 		SubjSync:                         s.handleSync(),
+		SubjUsageList:                    s.handleListUsage(),
+		SubjUsageRecord:                  s.handleAddUsageRecord(),
 	}
 
 	for k, v := range submap {
@@ -209,6 +301,10 @@ func (ns *Server) forwardProviderEvents() {
 		pub(SubjPriceUpdated, p2)
 	})
 
+	p.OnPaymentAdded(func(p *pay.Payment) {
+		pub(SubjPaymentSucceeded, p)
+	})
+
 	p.OnSeatAdded(func(s1 *pay.Subscription, username string) {
 		pub(SubjSubscriptionUserAdded, pay.SubscriptionUser{
 			SubscriptionID: s1.ID,
@@ -222,6 +318,95 @@ func (ns *Server) forwardProviderEvents() {
 			Username:       username,
 		})
 	})
+
+	p.OnSeatRoleChanged(func(_ *pay.Subscription, su *pay.SubscriptionUser) {
+		pub(SubjSubscriptionUserUpdated, su)
+	})
+
+	p.OnInviteAdded(func(i *pay.SubscriptionInvite) {
+		pub(SubjSubscriptionInviteAdded, i)
+	})
+
+	p.OnInviteResent(func(i *pay.SubscriptionInvite) {
+		pub(SubjSubscriptionInviteResent, i)
+	})
+
+	p.OnInviteAccepted(func(i *pay.SubscriptionInvite) {
+		pub(SubjSubscriptionInviteAccepted, i)
+	})
+
+	p.OnInviteRevoked(func(i *pay.SubscriptionInvite) {
+		pub(SubjSubscriptionInviteRevoked, i)
+	})
+
+	p.OnInviteExpired(func(i *pay.SubscriptionInvite) {
+		pub(SubjSubscriptionInviteExpired, i)
+	})
+
+	p.OnCardExpiring(func(c *pay.CardExpiry) {
+		pub(SubjCustomerCardExpiring, c)
+	})
+
+	p.OnPaymentFailed(func(f *pay.PaymentFailure) {
+		pub(SubjSubscriptionPaymentFailed, f)
+	})
+
+	p.OnGraceExpiring(func(s *pay.Subscription) {
+		pub(SubjSubscriptionGraceExpiring, s)
+	})
+}
+
+// job is work that the server runs periodically
+type job struct {
+	name     string
+	interval time.Duration
+	run      func() error
+}
+
+// jobs returns the periodic work of the server
+func (s *Server) jobs() []job {
+	return []job{
+		{"expiring invites", time.Minute, func() error {
+			_, err := s.provider.ExpireSubscriptionInvites()
+			return err
+		}},
+		{"reporting usage", time.Minute, func() error {
+			_, err := s.provider.ReportUsage()
+			return err
+		}},
+		{"checking card expiry", time.Hour, func() error {
+			_, err := s.provider.NotifyExpiringCards(pay.CardExpiryNotice)
+			return err
+		}},
+		{"checking grace periods", time.Minute, func() error {
+			// reminders go out before subscriptions whose grace period ended are deactivated
+			_, remindErr := s.provider.RemindGracePeriods()
+			_, expireErr := s.provider.ExpireGracePeriods()
+			return errors.Join(remindErr, expireErr)
+		}},
+	}
+}
+
+// runJobs runs every job once and then at its interval until the context is done
+func (s *Server) runJobs(ctx context.Context) {
+	for _, j := range s.jobs() {
+		go func(j job) {
+			t := time.NewTicker(j.interval)
+			defer t.Stop()
+
+			for {
+				if err := j.run(); err != nil {
+					log.Printf("error %s: %v", j.name, err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+			}
+		}(j)
+	}
 }
 
 // ---------------------------------------------------
@@ -232,11 +417,11 @@ func (s *Server) handleAddCustomer() natsHandler {
 			return err
 		}
 
-		if err := s.provider.AddCustomer(&c); err != nil {
+		if err := s.providerFor(msg).AddCustomer(&c); err != nil {
 			return err
 		}
 
-		return s.reply(msg, nil)
+		return s.reply(msg, &c)
 	}
 }
 
@@ -267,6 +452,22 @@ func (s *Server) handleGetCustomerByID() natsHandler {
 	}
 }
 
+func (s *Server) handleListPaymentMethods() natsHandler {
+	return func(msg *nats.Msg) error {
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		methods, err := s.provider.ListPaymentMethodsByCustomerID(id)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, methods)
+	}
+}
+
 func (s *Server) handleGetCustomerByProvider() natsHandler {
 	return func(msg *nats.Msg) error {
 		c, err := s.provider.GetCustomerByProvider(pay.ProviderStripe, string(msg.Data))
@@ -321,11 +522,11 @@ func (s *Server) handleAddPlan() natsHandler {
 		if err := json.Unmarshal(msg.Data, &pl); err != nil {
 			return err
 		}
-		if err := s.provider.AddPlan(&pl); err != nil {
+		if err := s.providerFor(msg).AddPlan(&pl); err != nil {
 			return err
 		}
 
-		return s.reply(msg, nil)
+		return s.reply(msg, &pl)
 	}
 }
 
@@ -410,6 +611,99 @@ func (s *Server) handleGetPlansByUsername() natsHandler {
 	}
 }
 
+func (s *Server) handleListPlanEntitlements() natsHandler {
+	return func(msg *nats.Msg) error {
+		planID, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		ents, err := s.provider.ListPlanEntitlements(planID)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, ents)
+	}
+}
+
+func (s *Server) handleSetPlanEntitlements() natsHandler {
+	return func(msg *nats.Msg) error {
+		var req pay.SetEntitlementsRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return err
+		}
+
+		if err := s.provider.SetPlanEntitlements(req.PlanID, req.Entitlements); err != nil {
+			return err
+		}
+
+		return s.reply(msg, req.Entitlements)
+	}
+}
+
+func (s *Server) handleCheckEntitlement() natsHandler {
+	return func(msg *nats.Msg) error {
+		var check pay.EntitlementCheck
+		if err := json.Unmarshal(msg.Data, &check); err != nil {
+			return err
+		}
+
+		ent, err := s.provider.CheckEntitlement(&check)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, ent)
+	}
+}
+
+func (s *Server) handleListEntitlementsByUsername() natsHandler {
+	return func(msg *nats.Msg) error {
+		ents, err := s.provider.ListEntitlementsByUsername(string(msg.Data))
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, ents)
+	}
+}
+
+func (s *Server) handleAddUsageRecord() natsHandler {
+	return func(msg *nats.Msg) error {
+		var rec pay.UsageRecord
+		if err := json.Unmarshal(msg.Data, &rec); err != nil {
+			return err
+		}
+
+		if rec.IdempotencyKey == "" && msg.Header != nil {
+			rec.IdempotencyKey = msg.Header.Get(HeaderIdempotencyKey)
+		}
+
+		if err := s.provider.AddUsageRecord(&rec); err != nil {
+			return err
+		}
+
+		return s.reply(msg, &rec)
+	}
+}
+
+func (s *Server) handleListUsage() natsHandler {
+	return func(msg *nats.Msg) error {
+		var req pay.UsageRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return err
+		}
+
+		usage, err := s.provider.ListUsage(&req)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, usage)
+	}
+}
+
 func (s *Server) handleListPlans() natsHandler {
 	return func(msg *nats.Msg) error {
 		plans, err := s.provider.ListPlans()
@@ -469,236 +763,717 @@ func (s *Server) handleListSubscriptions() natsHandler {
 	}
 }
 
-func (s *Server) handleListSubscriptionsByUsername() natsHandler {
+func (s *Server) handleListSubscriptionsActiveAt() natsHandler {
 	return func(msg *nats.Msg) error {
-		subs, err := s.provider.ListSubscriptionsByUsername(string(msg.Data))
+		t, err := time.Parse(time.RFC3339, string(msg.Data))
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		history, err := s.provider.ListSubscriptionsActiveAt(t)
 		if err != nil {
 			return err
 		}
 
-		return s.reply(msg, subs)
+		return s.reply(msg, history)
 	}
 }
 
-func (s *Server) handleListSubscriptionsByPlanID() natsHandler {
+func (s *Server) handleCancelSubscription() natsHandler {
 	return func(msg *nats.Msg) error {
-		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
-		if err != nil {
+		var req pay.CancelSubscriptionRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
 			return ErrBadRequest
 		}
 
-		subs, err := s.provider.ListSubscriptionsByPlanID(id)
-		if err != nil {
+		if err := s.providerFor(msg).CancelSubscription(&req); err != nil {
 			return err
 		}
 
-		return s.reply(msg, subs)
+		return s.reply(msg, nil)
 	}
 }
 
-func (s *Server) handleListSubscriptionsByCustomerID() natsHandler {
+func (s *Server) handlePauseSubscription() natsHandler {
 	return func(msg *nats.Msg) error {
 		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
 		if err != nil {
 			return ErrBadRequest
 		}
 
-		subs, err := s.provider.ListSubscriptionsByCustomerID(id)
-		if err != nil {
+		if err := s.providerFor(msg).PauseSubscription(id); err != nil {
 			return err
 		}
 
-		return s.reply(msg, subs)
+		return s.reply(msg, nil)
 	}
 }
 
-func (s *Server) handleGetSubscriptionByProviderID() natsHandler {
+func (s *Server) handleResumeSubscription() natsHandler {
 	return func(msg *nats.Msg) error {
-		sub, err := s.provider.GetSubscriptionByProvider(pay.ProviderStripe, string(msg.Data))
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
 		if err != nil {
+			return ErrBadRequest
+		}
+
+		if err := s.providerFor(msg).ResumeSubscription(id); err != nil {
 			return err
 		}
 
-		return s.reply(msg, sub)
+		return s.reply(msg, nil)
 	}
 }
 
-func (s *Server) handleGetSubscriptionByID() natsHandler {
+func (s *Server) handleChangeSubscriptionPrice() natsHandler {
 	return func(msg *nats.Msg) error {
-		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
-		if err != nil {
-			return err
+		var req pay.ChangePriceRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return ErrBadRequest
+		}
+
+		err := s.providerFor(msg).ChangeSubscriptionPrice(&req)
+		if errors.Is(err, pay.ErrInvalidProration) {
+			return ErrBadRequest
 		}
 
-		sub, err := s.provider.GetSubscriptionByID(id)
 		if err != nil {
 			return err
 		}
 
-		return s.reply(msg, sub)
+		return s.reply(msg, nil)
 	}
 }
 
-// ------------------------------------------------------------
-func (s *Server) handleListPrices() natsHandler {
+func (s *Server) handleApplySubscriptionDiscount() natsHandler {
 	return func(msg *nats.Msg) error {
-		prices, err := s.provider.ListAllPrices()
-		if err != nil {
+		var req pay.DiscountRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return ErrBadRequest
+		}
+
+		if err := s.providerFor(msg).ApplySubscriptionDiscount(&req); err != nil {
 			return err
 		}
 
-		return s.reply(msg, prices)
+		return s.reply(msg, nil)
 	}
 }
 
-func (s *Server) handleListPricesByPlanID() natsHandler {
+func (s *Server) handleRemoveSubscriptionDiscount() natsHandler {
 	return func(msg *nats.Msg) error {
-		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		subID, err := strconv.ParseInt(string(msg.Data), 10, 64)
 		if err != nil {
 			return ErrBadRequest
 		}
 
-		subs, err := s.provider.ListPricesByPlanID(id)
-		if err != nil {
+		if err := s.providerFor(msg).RemoveSubscriptionDiscount(subID); err != nil {
 			return err
 		}
 
-		return s.reply(msg, subs)
+		return s.reply(msg, nil)
 	}
 }
 
-func (s *Server) handleGetPriceByID() natsHandler {
+func (s *Server) handleAddCoupon() natsHandler {
 	return func(msg *nats.Msg) error {
-		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
-		if err != nil {
-			return ErrBadRequest
+		var c pay.Coupon
+		if err := json.Unmarshal(msg.Data, &c); err != nil {
+			return err
 		}
 
-		pr, err := s.provider.GetPriceByID(id)
-		if err != nil {
+		if err := s.providerFor(msg).AddCoupon(&c); err != nil {
 			return err
 		}
 
-		return s.reply(msg, pr)
+		return s.reply(msg, &c)
 	}
 }
 
-func (s *Server) handleGetPriceByProviderID() natsHandler {
+func (s *Server) handleListCoupons() natsHandler {
 	return func(msg *nats.Msg) error {
-		pr, err := s.provider.GetPriceByProvider(pay.ProviderStripe, string(msg.Data))
+		coupons, err := s.provider.ListCoupons()
 		if err != nil {
 			return err
 		}
 
-		return s.reply(msg, pr)
+		return s.reply(msg, coupons)
 	}
 }
 
-func (s *Server) handleAddPrice() natsHandler {
+func (s *Server) handleAddPromotionCode() natsHandler {
 	return func(msg *nats.Msg) error {
-		var pr pay.Price
-		if err := json.Unmarshal(msg.Data, &pr); err != nil {
+		var pc pay.PromotionCode
+		if err := json.Unmarshal(msg.Data, &pc); err != nil {
 			return err
 		}
-		if err := s.provider.AddPrice(&pr); err != nil {
+
+		if err := s.providerFor(msg).AddPromotionCode(&pc); err != nil {
 			return err
 		}
 
-		return s.reply(msg, nil)
+		return s.reply(msg, &pc)
 	}
 }
 
-// -------------------------------------------------------------
-func (s *Server) handleAddSubscriptionUser() natsHandler {
+// handleListPromotionCodes lists the promotion codes of the coupon id in the message, or every code when it is empty
+func (s *Server) handleListPromotionCodes() natsHandler {
 	return func(msg *nats.Msg) error {
-		var su pay.SubscriptionUser
-		if err := json.Unmarshal(msg.Data, &su); err != nil {
-			return err
+		if len(msg.Data) == 0 {
+			codes, err := s.provider.ListPromotionCodes()
+			if err != nil {
+				return err
+			}
+
+			return s.reply(msg, codes)
+		}
+
+		couponID, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
 		}
-		if err := s.provider.AddSubscriptionUser(&su); err != nil {
+
+		codes, err := s.provider.ListPromotionCodesByCouponID(couponID)
+		if err != nil {
 			return err
 		}
 
-		return s.reply(msg, nil)
+		return s.reply(msg, codes)
 	}
 }
 
-func (s *Server) handleCountSubscriptionUsers() natsHandler {
+func (s *Server) handleListSubscriptionItems() natsHandler {
 	return func(msg *nats.Msg) error {
-		subID, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
 		if err != nil {
 			return ErrBadRequest
 		}
-		count, err := s.provider.CountSubscriptionUsers(subID)
+
+		items, err := s.provider.ListSubscriptionItems(id)
 		if err != nil {
 			return err
 		}
 
-		return s.reply(msg, count)
+		return s.reply(msg, items)
 	}
 }
 
-func (s *Server) handleListSubscriptionUsers() natsHandler {
+func (s *Server) handleListSubscriptionHistory() natsHandler {
 	return func(msg *nats.Msg) error {
-		subID, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
 		if err != nil {
 			return ErrBadRequest
 		}
-		usernames, err := s.provider.ListUsernames(subID)
+
+		history, err := s.provider.ListSubscriptionHistory(id)
 		if err != nil {
 			return err
 		}
 
-		return s.reply(msg, usernames)
+		return s.reply(msg, history)
 	}
 }
 
-func (s *Server) handleRemoveSubscriptionUser() natsHandler {
+func (s *Server) handleListSubscriptionsByUsername() natsHandler {
 	return func(msg *nats.Msg) error {
-		var su pay.SubscriptionUser
-		if err := json.Unmarshal(msg.Data, &su); err != nil {
-			return err
-		}
-		if err := s.provider.RemoveSubscriptionUser(&su); err != nil {
+		subs, err := s.provider.ListSubscriptionsByUsername(string(msg.Data))
+		if err != nil {
 			return err
 		}
 
-		return s.reply(msg, nil)
+		return s.reply(msg, subs)
 	}
 }
 
-// ------------------------------------------------------------
-
-func (s *Server) handleCheckout() natsHandler {
+func (s *Server) handleListSubscriptionsByPlanID() natsHandler {
 	return func(msg *nats.Msg) error {
-		var req pay.CheckoutRequest
-		if err := json.Unmarshal(msg.Data, &req); err != nil {
-			return err
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
 		}
 
-		url, err := s.provider.Checkout(&req)
+		subs, err := s.provider.ListSubscriptionsByPlanID(id)
 		if err != nil {
-			return nil
+			return err
 		}
 
-		return s.reply(msg, url)
+		return s.reply(msg, subs)
 	}
 }
 
-func (s *Server) handleSync() natsHandler {
+func (s *Server) handleListSubscriptionsByCustomerID() natsHandler {
 	return func(msg *nats.Msg) error {
-		if err := s.provider.Sync(); err != nil {
-			return err
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
 		}
 
-		return s.reply(msg, nil)
+		subs, err := s.provider.ListSubscriptionsByCustomerID(id)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, subs)
+	}
+}
+
+func (s *Server) handleGetSubscriptionByProviderID() natsHandler {
+	return func(msg *nats.Msg) error {
+		sub, err := s.provider.GetSubscriptionByProvider(pay.ProviderStripe, string(msg.Data))
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, sub)
+	}
+}
+
+func (s *Server) handleGetSubscriptionByID() natsHandler {
+	return func(msg *nats.Msg) error {
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		sub, err := s.provider.GetSubscriptionByID(id)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, sub)
+	}
+}
+
+// ------------------------------------------------------------
+func (s *Server) handleListPrices() natsHandler {
+	return func(msg *nats.Msg) error {
+		prices, err := s.provider.ListAllPrices()
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, prices)
+	}
+}
+
+func (s *Server) handleListPricesByPlanID() natsHandler {
+	return func(msg *nats.Msg) error {
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		subs, err := s.provider.ListPricesByPlanID(id)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, subs)
+	}
+}
+
+func (s *Server) handleGetPriceByID() natsHandler {
+	return func(msg *nats.Msg) error {
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		pr, err := s.provider.GetPriceByID(id)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, pr)
+	}
+}
+
+func (s *Server) handleGetPriceByProviderID() natsHandler {
+	return func(msg *nats.Msg) error {
+		pr, err := s.provider.GetPriceByProvider(pay.ProviderStripe, string(msg.Data))
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, pr)
+	}
+}
+
+func (s *Server) handleAddPrice() natsHandler {
+	return func(msg *nats.Msg) error {
+		var pr pay.Price
+		if err := json.Unmarshal(msg.Data, &pr); err != nil {
+			return err
+		}
+		if err := s.providerFor(msg).AddPrice(&pr); err != nil {
+			return err
+		}
+
+		return s.reply(msg, &pr)
+	}
+}
+
+func (s *Server) handleUpdatePrice() natsHandler {
+	return func(msg *nats.Msg) error {
+		var pr pay.Price
+		if err := json.Unmarshal(msg.Data, &pr); err != nil {
+			return ErrBadRequest
+		}
+
+		if err := s.provider.UpdatePrice(&pr); err != nil {
+			return err
+		}
+
+		return s.reply(msg, &pr)
+	}
+}
+
+// -------------------------------------------------------------
+func (s *Server) handleAddSubscriptionUser() natsHandler {
+	return func(msg *nats.Msg) error {
+		var su pay.SubscriptionUser
+		if err := json.Unmarshal(msg.Data, &su); err != nil {
+			return err
+		}
+		if err := s.providerFor(msg).AddSubscriptionUser(&su); err != nil {
+			return err
+		}
+
+		return s.reply(msg, nil)
+	}
+}
+
+func (s *Server) handleGetSubscriptionSeats() natsHandler {
+	return func(msg *nats.Msg) error {
+		subID, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		seats, err := s.provider.GetSeats(subID)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, seats)
+	}
+}
+
+func (s *Server) handleCountSubscriptionUsers() natsHandler {
+	return func(msg *nats.Msg) error {
+		subID, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+		count, err := s.provider.CountSubscriptionUsers(subID)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, count)
+	}
+}
+
+func (s *Server) handleListSubscriptionUsers() natsHandler {
+	return func(msg *nats.Msg) error {
+		subID, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+		users, err := s.provider.ListSubscriptionUsers(subID)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, users)
+	}
+}
+
+func (s *Server) handleSetSubscriptionUserRole() natsHandler {
+	return func(msg *nats.Msg) error {
+		var su pay.SubscriptionUser
+		if err := json.Unmarshal(msg.Data, &su); err != nil {
+			return err
+		}
+
+		if err := s.provider.SetSubscriptionUserRole(&su); err != nil {
+			return err
+		}
+
+		return s.reply(msg, nil)
+	}
+}
+
+func (s *Server) handleTransferSubscriptionOwnership() natsHandler {
+	return func(msg *nats.Msg) error {
+		var req pay.TransferOwnershipRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return err
+		}
+
+		if err := s.provider.TransferSubscriptionOwnership(&req); err != nil {
+			return err
+		}
+
+		return s.reply(msg, nil)
+	}
+}
+
+func (s *Server) handleRemoveSubscriptionUser() natsHandler {
+	return func(msg *nats.Msg) error {
+		var su pay.SubscriptionUser
+		if err := json.Unmarshal(msg.Data, &su); err != nil {
+			return err
+		}
+		if err := s.provider.RemoveSubscriptionUser(&su); err != nil {
+			return err
+		}
+
+		return s.reply(msg, nil)
+	}
+}
+
+func (s *Server) handleAddSubscriptionInvite() natsHandler {
+	return func(msg *nats.Msg) error {
+		var inv pay.SubscriptionInvite
+		if err := json.Unmarshal(msg.Data, &inv); err != nil {
+			return err
+		}
+
+		if err := s.provider.AddSubscriptionInvite(&inv); err != nil {
+			return err
+		}
+
+		return s.reply(msg, &inv)
+	}
+}
+
+func (s *Server) handleAcceptSubscriptionInvite() natsHandler {
+	return func(msg *nats.Msg) error {
+		var req pay.AcceptInviteRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return err
+		}
+
+		inv, err := s.providerFor(msg).AcceptSubscriptionInvite(req.Token, req.Username)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, inv)
+	}
+}
+
+func (s *Server) handleListSubscriptionInvites() natsHandler {
+	return func(msg *nats.Msg) error {
+		subID, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		invites, err := s.provider.ListSubscriptionInvites(subID)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, invites)
+	}
+}
+
+func (s *Server) handleResendSubscriptionInvite() natsHandler {
+	return func(msg *nats.Msg) error {
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		inv, err := s.provider.ResendSubscriptionInvite(id)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, inv)
+	}
+}
+
+func (s *Server) handleRevokeSubscriptionInvite() natsHandler {
+	return func(msg *nats.Msg) error {
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		inv, err := s.provider.RevokeSubscriptionInvite(id)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, inv)
+	}
+}
+
+// ------------------------------------------------------------
+
+func (s *Server) handleCheckout() natsHandler {
+	return func(msg *nats.Msg) error {
+		var req pay.CheckoutRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return err
+		}
+
+		url, err := s.providerFor(msg).Checkout(&req)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, url)
+	}
+}
+
+func (s *Server) handleGetPaymentByProviderID() natsHandler {
+	return func(msg *nats.Msg) error {
+		p, err := s.provider.GetPaymentByProvider(pay.ProviderStripe, string(msg.Data))
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, p)
+	}
+}
+
+func (s *Server) handleListPaymentsByCustomerID() natsHandler {
+	return func(msg *nats.Msg) error {
+		id, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err != nil {
+			return ErrBadRequest
+		}
+
+		payments, err := s.provider.ListPaymentsByCustomerID(id)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, payments)
+	}
+}
+
+func (s *Server) handlePortal() natsHandler {
+	return func(msg *nats.Msg) error {
+		var req pay.PortalRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return ErrBadRequest
+		}
+
+		url, err := s.provider.CreatePortalSession(req.CustomerID, req.ReturnURL)
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, url)
+	}
+}
+
+func (s *Server) handleSync() natsHandler {
+	return func(msg *nats.Msg) error {
+		if err := s.provider.Sync(); err != nil {
+			return err
+		}
+
+		return s.reply(msg, nil)
+	}
+}
+
+// ------------------------------------------------------------
+func (s *Server) handleGetAnalytics() natsHandler {
+	return func(msg *nats.Msg) error {
+		req, err := analyticsRequest(msg)
+		if err != nil {
+			return err
+		}
+
+		a, err := s.provider.GetAnalytics(req)
+		if errors.Is(err, pay.ErrInvalidInterval) {
+			return ErrBadRequest
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, a)
+	}
+}
+
+func (s *Server) handleListRevenue() natsHandler {
+	return func(msg *nats.Msg) error {
+		revenue, err := s.provider.ListRevenue()
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, revenue)
+	}
+}
+
+func (s *Server) handleListRevenueByPlan() natsHandler {
+	return func(msg *nats.Msg) error {
+		plans, err := s.provider.ListRevenueByPlan()
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, plans)
+	}
+}
+
+func (s *Server) handleListSubscriptionPeriods() natsHandler {
+	return func(msg *nats.Msg) error {
+		req, err := analyticsRequest(msg)
+		if err != nil {
+			return err
+		}
+
+		periods, err := s.provider.ListSubscriptionPeriods(req)
+		if errors.Is(err, pay.ErrInvalidInterval) {
+			return ErrBadRequest
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, periods)
 	}
 }
 
+func (s *Server) handleGetTrialConversion() natsHandler {
+	return func(msg *nats.Msg) error {
+		t, err := s.provider.GetTrialConversion()
+		if err != nil {
+			return err
+		}
+
+		return s.reply(msg, t)
+	}
+}
+
+// analyticsRequest decodes the optional analytics request in the message body
+func analyticsRequest(msg *nats.Msg) (*pay.AnalyticsRequest, error) {
+	var req pay.AnalyticsRequest
+	if len(msg.Data) == 0 {
+		return &req, nil
+	}
+
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return nil, ErrBadRequest
+	}
+
+	return &req, nil
+}
+
 // ------------------------------------------------------------
 type natsHandler func(msg *nats.Msg) error
 
-func (Server) reply(msg *nats.Msg, v any) error {
+func (s *Server) reply(msg *nats.Msg, v any) error {
 	data, err := json.Marshal(v)
 	if err != nil {
 		return err
@@ -714,11 +1489,55 @@ func (Server) reply(msg *nats.Msg, v any) error {
 		return err
 	}
 
+	if key := idempotencyKey(msg); key != "" {
+		if err := s.provider.AddIdempotentRequest(&pay.IdempotentRequest{
+			Key:      key,
+			Subject:  msg.Subject,
+			Response: resdata,
+		}); err != nil {
+			log.Printf("error storing idempotent request %s on subj %s: %v", key, msg.Subject, err)
+		}
+	}
+
 	return msg.Respond(resdata)
 }
 
+// replay responds with the stored response when msg is a repeat of an idempotent request
+func (s *Server) replay(msg *nats.Msg) bool {
+	key := idempotencyKey(msg)
+	if key == "" {
+		return false
+	}
+
+	req, err := s.provider.GetIdempotentRequest(msg.Subject, key)
+	if err != nil {
+		return false
+	}
+
+	msg.Respond(req.Response)
+	return true
+}
+
+// providerFor returns the provider that forwards the idempotency key of msg to stripe
+func (s *Server) providerFor(msg *nats.Msg) *pay.StripeProvider {
+	return s.provider.WithIdempotencyKey(idempotencyKey(msg))
+}
+
+// idempotencyKey returns the key sent in the header of msg if its subject supports idempotency
+func idempotencyKey(msg *nats.Msg) string {
+	if msg.Header == nil || !idempotentSubjects[msg.Subject] {
+		return ""
+	}
+
+	return msg.Header.Get(HeaderIdempotencyKey)
+}
+
 func (s *Server) sub(subj string, h natsHandler) (*nats.Subscription, error) {
 	return s.nc.QueueSubscribe(subj, s.cfg.Queue, func(msg *nats.Msg) {
+		if s.replay(msg) {
+			return
+		}
+
 		if err := h(msg); err != nil {
 			data, err := json.Marshal(&response{
 				Success: false,
@@ -0,0 +1,270 @@
+package cent
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cristosal/cent/pay"
+)
+
+// OpenAPIPath is where the openapi document describing the json api is served
+const OpenAPIPath = "/api/openapi.json"
+
+// apiOperation describes a single route of the json api for the openapi document
+type apiOperation struct {
+	Method   string
+	Path     string
+	Summary  string
+	Query    []string // optional query parameters
+	Request  any      // request body, nil when the operation has no body
+	Response any      // response body, nil when the operation returns no content
+	Status   int      // status code on success
+}
+
+// apiOperations lists every route served by handleAPI
+var apiOperations = []apiOperation{
+	{Method: http.MethodGet, Path: "/customers", Summary: "List customers or find one by email or provider id", Query: []string{"email", "provider_id"}, Response: []pay.Customer{}, Status: http.StatusOK},
+	{Method: http.MethodPost, Path: "/customers", Summary: "Create a customer", Request: pay.Customer{}, Response: pay.Customer{}, Status: http.StatusCreated},
+	{Method: http.MethodGet, Path: "/customers/{id}", Summary: "Get a customer", Response: pay.Customer{}, Status: http.StatusOK},
+	{Method: http.MethodPut, Path: "/customers/{id}", Summary: "Update a customer", Request: pay.Customer{}, Response: pay.Customer{}, Status: http.StatusOK},
+	{Method: http.MethodDelete, Path: "/customers/{id}", Summary: "Delete a customer", Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/customers/{id}/payment_methods", Summary: "List the saved payment methods of a customer", Response: []pay.PaymentMethod{}, Status: http.StatusOK},
+	{Method: http.MethodGet, Path: "/plans", Summary: "List plans or find one by name or provider id", Query: []string{"name", "provider_id", "username", "active"}, Response: []pay.Plan{}, Status: http.StatusOK},
+	{Method: http.MethodPost, Path: "/plans", Summary: "Create a plan", Request: pay.Plan{}, Response: pay.Plan{}, Status: http.StatusCreated},
+	{Method: http.MethodGet, Path: "/plans/{id}", Summary: "Get a plan", Response: pay.Plan{}, Status: http.StatusOK},
+	{Method: http.MethodPut, Path: "/plans/{id}", Summary: "Update a plan", Request: pay.Plan{}, Response: pay.Plan{}, Status: http.StatusOK},
+	{Method: http.MethodDelete, Path: "/plans/{id}", Summary: "Delete a plan", Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/plans/{id}/entitlements", Summary: "List the features granted by a plan", Response: []pay.Entitlement{}, Status: http.StatusOK},
+	{Method: http.MethodPut, Path: "/plans/{id}/entitlements", Summary: "Replace the features granted by a plan", Request: []pay.Entitlement{}, Response: []pay.Entitlement{}, Status: http.StatusOK},
+	{Method: http.MethodPost, Path: "/usage", Summary: "Record usage of a meter by a subscription or user", Request: pay.UsageRecord{}, Response: pay.UsageRecord{}, Status: http.StatusCreated},
+	{Method: http.MethodGet, Path: "/coupons", Summary: "List coupons", Response: []pay.Coupon{}, Status: http.StatusOK},
+	{Method: http.MethodPost, Path: "/coupons", Summary: "Create a coupon in stripe", Request: pay.Coupon{}, Response: pay.Coupon{}, Status: http.StatusCreated},
+	{Method: http.MethodGet, Path: "/coupons/{id}", Summary: "Get a coupon", Response: pay.Coupon{}, Status: http.StatusOK},
+	{Method: http.MethodGet, Path: "/coupons/{id}/promotion_codes", Summary: "List the promotion codes of a coupon", Response: []pay.PromotionCode{}, Status: http.StatusOK},
+	{Method: http.MethodPost, Path: "/coupons/{id}/promotion_codes", Summary: "Create a promotion code for a coupon in stripe", Request: pay.PromotionCode{}, Response: pay.PromotionCode{}, Status: http.StatusCreated},
+	{Method: http.MethodGet, Path: "/entitlements", Summary: "List the features of a user or check a single feature", Query: []string{"username", "feature"}, Response: []pay.UserEntitlement{}, Status: http.StatusOK},
+	{Method: http.MethodGet, Path: "/prices", Summary: "List prices or find one by provider id", Query: []string{"provider_id", "plan_id"}, Response: []pay.Price{}, Status: http.StatusOK},
+	{Method: http.MethodPost, Path: "/prices", Summary: "Create a price", Request: pay.Price{}, Response: pay.Price{}, Status: http.StatusCreated},
+	{Method: http.MethodGet, Path: "/prices/{id}", Summary: "Get a price", Response: pay.Price{}, Status: http.StatusOK},
+	{Method: http.MethodPut, Path: "/prices/{id}", Summary: "Update the active flag, nickname and metadata of a price", Request: pay.Price{}, Response: pay.Price{}, Status: http.StatusOK},
+	{Method: http.MethodGet, Path: "/subscriptions", Summary: "List subscriptions or find one by provider id", Query: []string{"provider_id", "username", "customer_id", "plan_id"}, Response: []pay.Subscription{}, Status: http.StatusOK},
+	{Method: http.MethodGet, Path: "/subscriptions/{id}", Summary: "Get a subscription", Response: pay.Subscription{}, Status: http.StatusOK},
+	{Method: http.MethodGet, Path: "/subscriptions/{id}/usage", Summary: "Get the usage of a subscription per meter, within its current period unless since and until are given", Query: []string{"meter", "since", "until"}, Response: []pay.Usage{}, Status: http.StatusOK},
+	{Method: http.MethodPut, Path: "/subscriptions/{id}/discount", Summary: "Discount a subscription with a coupon or promotion code, applied once stripe confirms it", Request: pay.DiscountRequest{}, Status: http.StatusAccepted},
+	{Method: http.MethodDelete, Path: "/subscriptions/{id}/discount", Summary: "Remove the discount of a subscription, applied once stripe confirms it", Status: http.StatusAccepted},
+	{Method: http.MethodGet, Path: "/subscriptions/{id}/seats", Summary: "Get the seat limit of a subscription and how many seats are taken", Response: pay.Seats{}, Status: http.StatusOK},
+	{Method: http.MethodGet, Path: "/subscriptions/{id}/users", Summary: "List the users attached to a subscription and their roles", Response: []pay.SubscriptionUser{}, Status: http.StatusOK},
+	{Method: http.MethodPost, Path: "/subscriptions/{id}/users", Summary: "Attach a user to a subscription", Request: pay.SubscriptionUser{}, Response: pay.SubscriptionUser{}, Status: http.StatusCreated},
+	{Method: http.MethodPut, Path: "/subscriptions/{id}/users/{username}", Summary: "Change the role of a user attached to a subscription", Request: pay.SubscriptionUser{}, Response: pay.SubscriptionUser{}, Status: http.StatusOK},
+	{Method: http.MethodDelete, Path: "/subscriptions/{id}/users/{username}", Summary: "Remove a user from a subscription", Status: http.StatusNoContent},
+	{Method: http.MethodPost, Path: "/checkout", Summary: "Create a checkout session", Request: pay.CheckoutRequest{}, Response: checkoutResponse{}, Status: http.StatusOK},
+	{Method: http.MethodPost, Path: "/portal", Summary: "Create a billing portal session for a customer", Request: pay.PortalRequest{}, Response: portalResponse{}, Status: http.StatusOK},
+	{Method: http.MethodPost, Path: "/sync", Summary: "Sync the local database with stripe", Status: http.StatusNoContent},
+}
+
+// openAPIEntities are included in the components of the document even when no route references them
+var openAPIEntities = []any{
+	pay.Customer{},
+	pay.Plan{},
+	pay.Price{},
+	pay.Subscription{},
+	pay.SubscriptionUser{},
+	pay.WebhookEvent{},
+}
+
+func handleOpenAPI() http.HandlerFunc {
+	doc := openAPIDocument()
+	return wrapAPI(func(w http.ResponseWriter, r *http.Request) error {
+		return writeJSON(w, http.StatusOK, doc)
+	})
+}
+
+// openAPIDocument builds the openapi 3 document from the api operations and pay entity types
+func openAPIDocument() map[string]any {
+	var (
+		schemas = make(map[string]any)
+		paths   = make(map[string]any)
+	)
+
+	for _, ent := range openAPIEntities {
+		openAPISchema(reflect.TypeOf(ent), schemas)
+	}
+
+	schemas["Error"] = map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"Error": map[string]any{"type": "string"}},
+	}
+
+	for _, op := range apiOperations {
+		item, ok := paths[APIPrefix+op.Path].(map[string]any)
+		if !ok {
+			item = make(map[string]any)
+			paths[APIPrefix+op.Path] = item
+		}
+
+		var params []any
+		for _, name := range pathParams(op.Path) {
+			params = append(params, map[string]any{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+
+		for _, name := range op.Query {
+			params = append(params, map[string]any{
+				"name":   name,
+				"in":     "query",
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+
+		responses := map[string]any{
+			"default": map[string]any{
+				"description": "Error",
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": map[string]any{"$ref": "#/components/schemas/Error"},
+					},
+				},
+			},
+		}
+
+		success := map[string]any{"description": http.StatusText(op.Status)}
+		if op.Response != nil {
+			success["content"] = map[string]any{
+				"application/json": map[string]any{
+					"schema": openAPISchema(reflect.TypeOf(op.Response), schemas),
+				},
+			}
+		}
+
+		responses[strconv.Itoa(op.Status)] = success
+
+		operation := map[string]any{
+			"summary":   op.Summary,
+			"responses": responses,
+		}
+
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": openAPISchema(reflect.TypeOf(op.Request), schemas),
+					},
+				},
+			}
+		}
+
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "cent",
+			"version": "v1",
+		},
+		"paths":    paths,
+		"security": []any{map[string]any{"bearer": []string{}}},
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// openAPISchema returns the schema for t. Structs are added to schemas and referenced by name
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		s := openAPISchema(t.Elem(), schemas)
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+
+		s["nullable"] = true
+		return s
+	}
+
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, exists := schemas[t.Name()]; exists {
+			return ref
+		}
+
+		props := make(map[string]any)
+		schemas[t.Name()] = map[string]any{"type": "object", "properties": props}
+
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+
+			name := f.Name
+			if tag := f.Tag.Get("json"); tag != "" {
+				if tag == "-" {
+					continue
+				}
+
+				if n, _, _ := strings.Cut(tag, ","); n != "" {
+					name = n
+				}
+			}
+
+			props[name] = openAPISchema(f.Type, schemas)
+		}
+
+		return ref
+	}
+
+	return map[string]any{}
+}
+
+// pathParams returns the names of the {param} segments in path
+func pathParams(path string) []string {
+	var params []string
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			params = append(params, strings.Trim(seg, "{}"))
+		}
+	}
+
+	return params
+}
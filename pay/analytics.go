@@ -0,0 +1,310 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cristosal/orm"
+)
+
+// Interval by which subscription counts are grouped
+type Interval = string
+
+const (
+	IntervalDay   Interval = "day"
+	IntervalWeek  Interval = "week"
+	IntervalMonth Interval = "month"
+)
+
+var ErrInvalidInterval = errors.New("invalid interval")
+
+type (
+	// Revenue is the recurring revenue in a single currency, net of the coupons that currently discount subscriptions.
+	// Amounts are in the smallest unit of the currency and annual prices are normalised to months.
+	Revenue struct {
+		Currency      string
+		MRR           int64 // monthly recurring revenue
+		ARR           int64 // annual recurring revenue
+		Subscriptions int64 // number of billed subscriptions
+	}
+
+	// PlanRevenue is the recurring revenue of a plan in a single currency
+	PlanRevenue struct {
+		PlanID        int64
+		PlanName      string
+		Currency      string
+		MRR           int64
+		ARR           int64
+		Subscriptions int64
+	}
+
+	// SubscriptionPeriod counts the subscriptions that started and ended within a period
+	SubscriptionPeriod struct {
+		Period  time.Time
+		New     int64
+		Churned int64
+	}
+
+	// TrialConversion counts the subscriptions whose trial has ended and how many of them are being billed
+	TrialConversion struct {
+		Ended     int64
+		Converted int64
+		Rate      float64
+	}
+
+	// AnalyticsRequest selects the periods for which subscriptions are counted
+	AnalyticsRequest struct {
+		Interval Interval
+		Since    time.Time
+	}
+
+	// Analytics summarises revenue and subscriptions
+	Analytics struct {
+		Revenue           []Revenue
+		Plans             []PlanRevenue
+		Periods           []SubscriptionPeriod
+		Trials            TrialConversion
+		ActiveSubscribers int64 // customers with at least one active subscription
+	}
+)
+
+// setDefaults counts subscriptions per month over the last year when no interval or start is given
+func (req *AnalyticsRequest) setDefaults() {
+	if req.Interval == "" {
+		req.Interval = IntervalMonth
+	}
+
+	if req.Since.IsZero() {
+		req.Since = time.Now().AddDate(-1, 0, 0)
+	}
+}
+
+// GetAnalytics returns the revenue, subscription and trial figures in a single summary
+func (r *Repo) GetAnalytics(req *AnalyticsRequest) (*Analytics, error) {
+	if req == nil {
+		req = new(AnalyticsRequest)
+	}
+
+	var (
+		a   Analytics
+		err error
+	)
+
+	if a.Revenue, err = r.ListRevenue(); err != nil {
+		return nil, fmt.Errorf("error getting revenue: %w", err)
+	}
+
+	if a.Plans, err = r.ListRevenueByPlan(); err != nil {
+		return nil, fmt.Errorf("error getting revenue by plan: %w", err)
+	}
+
+	if a.Periods, err = r.ListSubscriptionPeriods(req); err != nil {
+		return nil, fmt.Errorf("error getting subscription periods: %w", err)
+	}
+
+	trials, err := r.GetTrialConversion()
+	if err != nil {
+		return nil, fmt.Errorf("error getting trial conversion: %w", err)
+	}
+
+	a.Trials = *trials
+
+	if a.ActiveSubscribers, err = r.CountActiveSubscribers(); err != nil {
+		return nil, fmt.Errorf("error counting active subscribers: %w", err)
+	}
+
+	return &a, nil
+}
+
+// ListRevenue returns the recurring revenue of billed subscriptions per currency.
+// Subscriptions that are still in their trial do not contribute revenue.
+func (r *Repo) ListRevenue() ([]Revenue, error) {
+	sql := fmt.Sprintf(`
+		SELECT pr.currency, %[1]s AS mrr, %[1]s * 12 AS arr, COUNT(DISTINCT s.id)
+		FROM %[2]s s
+		INNER JOIN %[3]s si ON si.subscription_id = s.id
+		INNER JOIN %[4]s pr ON pr.id = si.price_id
+		%[5]s
+		WHERE %[6]s
+		GROUP BY pr.currency
+		ORDER BY pr.currency`,
+		mrrExpr,
+		orm.TableName(&Subscription{}),
+		orm.TableName(&SubscriptionItem{}),
+		orm.TableName(&Price{}),
+		discountJoin,
+		payingExpr,
+	)
+
+	var revenue []Revenue
+	if err := orm.Query(r.db, &revenue, sql); err != nil {
+		return nil, err
+	}
+
+	return revenue, nil
+}
+
+// ListRevenueByPlan returns the recurring revenue of billed subscriptions per plan and currency, highest first
+func (r *Repo) ListRevenueByPlan() ([]PlanRevenue, error) {
+	sql := fmt.Sprintf(`
+		SELECT pl.id, pl.name, pr.currency, %[1]s AS mrr, %[1]s * 12 AS arr, COUNT(DISTINCT s.id)
+		FROM %[2]s s
+		INNER JOIN %[3]s si ON si.subscription_id = s.id
+		INNER JOIN %[4]s pr ON pr.id = si.price_id
+		INNER JOIN %[5]s pl ON pl.id = pr.plan_id
+		%[6]s
+		WHERE %[7]s
+		GROUP BY pl.id, pl.name, pr.currency
+		ORDER BY mrr DESC, pl.name`,
+		mrrExpr,
+		orm.TableName(&Subscription{}),
+		orm.TableName(&SubscriptionItem{}),
+		orm.TableName(&Price{}),
+		orm.TableName(&Plan{}),
+		discountJoin,
+		payingExpr,
+	)
+
+	var plans []PlanRevenue
+	if err := orm.Query(r.db, &plans, sql); err != nil {
+		return nil, err
+	}
+
+	return plans, nil
+}
+
+// ListSubscriptionPeriods counts new and churned subscriptions for every interval since the requested time.
+// Churn is taken from the subscription history and from stored subscription deleted webhook events that predate it.
+func (r *Repo) ListSubscriptionPeriods(req *AnalyticsRequest) ([]SubscriptionPeriod, error) {
+	if req == nil {
+		req = new(AnalyticsRequest)
+	}
+
+	req.setDefaults()
+
+	switch req.Interval {
+	case IntervalDay, IntervalWeek, IntervalMonth:
+	default:
+		return nil, ErrInvalidInterval
+	}
+
+	var (
+		sub     Subscription
+		event   WebhookEvent
+		history SubscriptionHistory
+	)
+
+	sql := fmt.Sprintf(`
+		WITH subs AS (
+			SELECT provider_id, MIN(created_at) AS created_at FROM (
+				SELECT provider_id, created_at FROM %[1]s
+				UNION
+				SELECT provider_id, changed_at FROM %[3]s WHERE change = '%[5]s'
+				UNION
+				SELECT payload->>'id', to_timestamp((payload->>'created')::bigint)
+				FROM %[2]s WHERE event_type = 'customer.subscription.deleted'
+			) created
+			GROUP BY provider_id
+		), churned AS (
+			SELECT provider_id, MIN(ended_at) AS ended_at FROM (
+				SELECT provider_id, changed_at AS ended_at
+				FROM %[3]s WHERE change = '%[4]s'
+				UNION
+				SELECT payload->>'id',
+					to_timestamp(COALESCE((payload->>'ended_at')::bigint, (payload->>'canceled_at')::bigint))
+				FROM %[2]s WHERE event_type = 'customer.subscription.deleted'
+			) ended
+			GROUP BY provider_id
+		), periods AS (
+			SELECT generate_series(date_trunc($1, $2::timestamptz), date_trunc($1, NOW()), ('1 ' || $1)::interval) AS period
+		)
+		SELECT p.period,
+			(SELECT COUNT(*) FROM subs s WHERE date_trunc($1, s.created_at) = p.period),
+			(SELECT COUNT(*) FROM churned c WHERE date_trunc($1, c.ended_at) = p.period)
+		FROM periods p
+		ORDER BY p.period`,
+		orm.TableName(&sub),
+		orm.TableName(&event),
+		orm.TableName(&history),
+		SubscriptionDeleted,
+		SubscriptionCreated,
+	)
+
+	var periods []SubscriptionPeriod
+	if err := orm.Query(r.db, &periods, sql, req.Interval, req.Since); err != nil {
+		return nil, err
+	}
+
+	return periods, nil
+}
+
+// GetTrialConversion returns how many subscriptions whose trial has ended were billed afterwards.
+// Trials are taken from the subscription history, so subscriptions that were canceled or removed after their trial still count.
+func (r *Repo) GetTrialConversion() (*TrialConversion, error) {
+	sql := fmt.Sprintf(`
+		WITH trials AS (
+			SELECT MAX(trial_end) AS trial_end, bool_or(status IN ('%s', '%s')) AS converted
+			FROM %s
+			GROUP BY provider, provider_id
+		)
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE converted)
+		FROM trials
+		WHERE trial_end <= NOW()`,
+		SubscriptionStatusActive,
+		SubscriptionStatusPastDue,
+		orm.TableName(&SubscriptionHistory{}),
+	)
+
+	var t TrialConversion
+	if err := r.db.QueryRow(sql).Scan(&t.Ended, &t.Converted); err != nil {
+		return nil, err
+	}
+
+	if t.Ended > 0 {
+		t.Rate = float64(t.Converted) / float64(t.Ended)
+	}
+
+	return &t, nil
+}
+
+// CountActiveSubscribers returns the number of customers with at least one active subscription
+func (r *Repo) CountActiveSubscribers() (int64, error) {
+	var count int64
+	sql := fmt.Sprintf("SELECT COUNT(DISTINCT customer_id) FROM %s WHERE active", orm.TableName(&Subscription{}))
+	if err := r.db.QueryRow(sql).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// mrrExpr normalises the amount of the joined subscription items si and their prices pr to a monthly amount, less the discount of the joined coupon c.
+// Percent off discounts every item, while amount off is taken from the item of the main price of the subscription when the currencies match.
+var mrrExpr = fmt.Sprintf(`ROUND(SUM(GREATEST(
+		si.quantity * %[1]s * (1 - COALESCE(c.percent_off, 0) / 100)
+			- CASE WHEN si.price_id = s.price_id AND c.currency = pr.currency THEN %[2]s ELSE 0 END,
+		0)))::bigint`,
+	monthlyExpr("pr.amount"),
+	monthlyExpr("c.amount_off"),
+)
+
+// monthlyExpr normalises an amount charged on the schedule of the joined price pr to a monthly amount
+func monthlyExpr(amount string) string {
+	return fmt.Sprintf(`CASE pr.schedule WHEN '%s' THEN %s WHEN '%s' THEN %s / 12.0 ELSE 0 END`,
+		PricingMonthly,
+		amount,
+		PricingAnnual,
+		amount,
+	)
+}
+
+// discountJoin joins the coupon c that is discounting the subscription s, if any.
+// Coupons that apply once only discount the first invoice and are left out of recurring revenue.
+var discountJoin = fmt.Sprintf(`LEFT JOIN %s c ON c.id = s.coupon_id AND c.duration != '%s' AND (s.discount_end IS NULL OR s.discount_end > NOW())`,
+	orm.TableName(&Coupon{}),
+	CouponOnce,
+)
+
+// payingExpr matches subscriptions s that are being billed, including those with a failed payment that is being retried
+var payingExpr = fmt.Sprintf(`s.status IN ('%s', '%s')`, SubscriptionStatusActive, SubscriptionStatusPastDue)
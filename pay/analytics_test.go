@@ -0,0 +1,42 @@
+package pay
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMonthlyExpr(t *testing.T) {
+	tests := []struct {
+		amount string
+		want   string
+	}{
+		{"pr.amount", "CASE pr.schedule WHEN 'monthly' THEN pr.amount WHEN 'annual' THEN pr.amount / 12.0 ELSE 0 END"},
+		{"c.amount_off", "CASE pr.schedule WHEN 'monthly' THEN c.amount_off WHEN 'annual' THEN c.amount_off / 12.0 ELSE 0 END"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.amount, func(t *testing.T) {
+			if got := monthlyExpr(tt.amount); got != tt.want {
+				t.Errorf("monthlyExpr() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMRRExpr(t *testing.T) {
+	// one-time prices normalise to zero and discounts never make an item negative
+	for _, part := range []string{
+		"si.quantity * " + monthlyExpr("pr.amount"),
+		"(1 - COALESCE(c.percent_off, 0) / 100)",
+		"THEN " + monthlyExpr("c.amount_off") + " ELSE 0 END",
+		"GREATEST(",
+	} {
+		if !strings.Contains(mrrExpr, part) {
+			t.Errorf("mrrExpr does not contain %s", part)
+		}
+	}
+
+	if !strings.Contains(discountJoin, "c.duration != 'once'") {
+		t.Errorf("discountJoin does not leave out coupons that apply once: %s", discountJoin)
+	}
+}
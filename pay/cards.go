@@ -0,0 +1,235 @@
+package pay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cristosal/orm"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/paymentmethod"
+)
+
+// CardExpiryNotice is how long before a card expires that its card expiring event is published
+const CardExpiryNotice = 30 * 24 * time.Hour
+
+// CardExpiry is a card that is about to expire along with the customer it belongs to
+type CardExpiry struct {
+	Customer      Customer
+	PaymentMethod PaymentMethod
+}
+
+// ListPaymentMethodsByCustomerID returns the payment methods saved for a customer, the default first
+func (r *Repo) ListPaymentMethodsByCustomerID(customerID int64) ([]PaymentMethod, error) {
+	var methods []PaymentMethod
+	if err := orm.List(r.db, &methods, "WHERE customer_id = $1 ORDER BY is_default DESC, created_at DESC", customerID); err != nil {
+		return nil, err
+	}
+
+	return methods, nil
+}
+
+// GetPaymentMethodByProvider returns the payment method with the given provider id
+func (r *Repo) GetPaymentMethodByProvider(provider, providerID string) (*PaymentMethod, error) {
+	var pm PaymentMethod
+	if err := orm.Get(r.db, &pm, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &pm, nil
+}
+
+// upsertPaymentMethod adds the payment method or updates the one with the same provider id.
+// The default flag is only changed by setDefaultPaymentMethod, and the expiry notification is kept unless the expiry changed.
+func (r *Repo) upsertPaymentMethod(pm *PaymentMethod) error {
+	prev, err := r.GetPaymentMethodByProvider(pm.Provider, pm.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return orm.Add(r.db, pm)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	pm.ID = prev.ID
+	pm.IsDefault = prev.IsDefault
+	if pm.ExpMonth == prev.ExpMonth && pm.ExpYear == prev.ExpYear {
+		pm.ExpiryNotifiedAt = prev.ExpiryNotifiedAt
+	}
+
+	return orm.UpdateByID(r.db, pm)
+}
+
+// setDefaultPaymentMethod makes the payment method with the provider id the only default of the customer.
+// An empty provider id leaves the customer without a default.
+func (r *Repo) setDefaultPaymentMethod(customerID int64, providerID string) error {
+	sql := fmt.Sprintf("UPDATE %s SET is_default = (provider_id = $2) WHERE customer_id = $1", orm.TableName(&PaymentMethod{}))
+	_, err := r.db.Exec(sql, customerID, providerID)
+	return err
+}
+
+func (r *Repo) removePaymentMethodByProvider(provider, providerID string) error {
+	return orm.Remove(r.db, &PaymentMethod{}, "WHERE provider = $1 AND provider_id = $2", provider, providerID)
+}
+
+// removePaymentMethodOrphans removes the payment methods of the customer that are not in ids
+func (r *Repo) removePaymentMethodOrphans(customerID int64, ids []string) error {
+	// a nil slice is sent as NULL, which would match no payment method
+	if ids == nil {
+		ids = []string{}
+	}
+
+	return orm.Remove(r.db, &PaymentMethod{}, "WHERE customer_id = $1 AND NOT (provider_id = ANY($2))", customerID, ids)
+}
+
+// NotifyExpiringCards publishes a card expiring event for every card that expires within notice and returns them.
+// Only cards that renewing subscriptions are charged to are included, which are the default card of the customer
+// or any of its cards when it has no default. Each card is only notified once per expiry date.
+func (r *Repo) NotifyExpiringCards(notice time.Duration) ([]CardExpiry, error) {
+	pm := PaymentMethod{}
+	sql := fmt.Sprintf(`
+		UPDATE %[1]s pm SET expiry_notified_at = NOW()
+		WHERE pm.expiry_notified_at IS NULL
+			AND pm.expires_at > NOW() AND pm.expires_at <= $1
+			AND (pm.is_default OR NOT EXISTS (SELECT 1 FROM %[1]s d WHERE d.customer_id = pm.customer_id AND d.is_default))
+			AND EXISTS (
+				SELECT 1 FROM %[2]s s
+				WHERE s.customer_id = pm.customer_id AND s.active AND NOT s.cancel_at_period_end AND s.cancel_at IS NULL
+			)
+		RETURNING %[3]s`,
+		pm.TableName(),
+		orm.TableName(&Subscription{}),
+		orm.Columns(&pm).PrefixedList("pm"),
+	)
+
+	var methods []PaymentMethod
+	if err := orm.Query(r.db, &methods, sql, time.Now().Add(notice)); err != nil {
+		return nil, err
+	}
+
+	expiring := make([]CardExpiry, 0, len(methods))
+	for _, m := range methods {
+		c, err := r.GetCustomerByID(m.CustomerID)
+		if err != nil {
+			return nil, err
+		}
+
+		exp := CardExpiry{Customer: *c, PaymentMethod: m}
+		expiring = append(expiring, exp)
+		r.cardExpiring(&exp)
+	}
+
+	return expiring, nil
+}
+
+// syncCustomerPaymentMethods stores the payment methods of a stripe customer and marks its default
+func (s *StripeProvider) syncCustomerPaymentMethods(cust *stripe.Customer, customerID int64) error {
+	var ids []string
+	it := paymentmethod.List(&stripe.PaymentMethodListParams{Customer: stripe.String(cust.ID)})
+	for it.Next() {
+		m := it.PaymentMethod()
+		ids = append(ids, m.ID)
+		if err := s.upsertPaymentMethod(convertPaymentMethod(m, customerID)); err != nil {
+			log.Printf("error syncing payment method %s: %v", m.ID, err)
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	if err := s.removePaymentMethodOrphans(customerID, ids); err != nil {
+		return err
+	}
+
+	return s.setDefaultPaymentMethod(customerID, defaultPaymentMethodID(cust))
+}
+
+// updateDefaultPaymentMethod marks the default payment method of an updated stripe customer,
+// fetching it from stripe when its attached event has not arrived yet
+func (s *StripeProvider) updateDefaultPaymentMethod(cust *stripe.Customer) error {
+	c, err := s.GetCustomerByProvider(ProviderStripe, cust.ID)
+	if err != nil {
+		return err
+	}
+
+	id := defaultPaymentMethodID(cust)
+	if id != "" {
+		if _, err := s.GetPaymentMethodByProvider(ProviderStripe, id); errors.Is(err, orm.ErrNotFound) {
+			m, err := paymentmethod.Get(id, nil)
+			if err != nil {
+				return err
+			}
+
+			if err := s.upsertPaymentMethod(convertPaymentMethod(m, c.ID)); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return s.setDefaultPaymentMethod(c.ID, id)
+}
+
+func (s *StripeProvider) handlePaymentMethodUpserted(data *stripe.EventData) error {
+	var m stripe.PaymentMethod
+	if err := json.Unmarshal(data.Raw, &m); err != nil {
+		return err
+	}
+
+	// detached payment methods have no customer and are removed by their own event
+	if m.Customer == nil {
+		return nil
+	}
+
+	c, err := s.GetCustomerByProvider(ProviderStripe, m.Customer.ID)
+	if err != nil {
+		return fmt.Errorf("could not get customer %s of payment method %s: %w", m.Customer.ID, m.ID, err)
+	}
+
+	return s.upsertPaymentMethod(convertPaymentMethod(&m, c.ID))
+}
+
+func (s *StripeProvider) handlePaymentMethodDetached(data *stripe.EventData) error {
+	var m stripe.PaymentMethod
+	if err := json.Unmarshal(data.Raw, &m); err != nil {
+		return err
+	}
+
+	return s.removePaymentMethodByProvider(ProviderStripe, m.ID)
+}
+
+func defaultPaymentMethodID(cust *stripe.Customer) string {
+	if cust.InvoiceSettings == nil || cust.InvoiceSettings.DefaultPaymentMethod == nil {
+		return ""
+	}
+
+	return cust.InvoiceSettings.DefaultPaymentMethod.ID
+}
+
+func convertPaymentMethod(m *stripe.PaymentMethod, customerID int64) *PaymentMethod {
+	pm := PaymentMethod{
+		CustomerID: customerID,
+		Provider:   ProviderStripe,
+		ProviderID: m.ID,
+		Type:       string(m.Type),
+		CreatedAt:  time.Unix(m.Created, 0),
+	}
+
+	if m.Card != nil {
+		pm.Brand = string(m.Card.Brand)
+		pm.Last4 = m.Card.Last4
+		pm.ExpMonth = m.Card.ExpMonth
+		pm.ExpYear = m.Card.ExpYear
+		if m.Card.ExpYear > 0 && m.Card.ExpMonth > 0 {
+			// cards work until the end of their expiry month
+			exp := time.Date(int(m.Card.ExpYear), time.Month(m.Card.ExpMonth)+1, 1, 0, 0, 0, 0, time.UTC)
+			pm.ExpiresAt = &exp
+		}
+	}
+
+	return &pm
+}
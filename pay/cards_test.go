@@ -0,0 +1,39 @@
+package pay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+func TestConvertPaymentMethodExpiry(t *testing.T) {
+	tests := []struct {
+		name string
+		card *stripe.PaymentMethodCard
+		want *time.Time
+	}{
+		{"no card", nil, nil},
+		{"mid year", &stripe.PaymentMethodCard{ExpMonth: 6, ExpYear: 2025}, date(2025, time.July)},
+		{"december rolls over to the next year", &stripe.PaymentMethodCard{ExpMonth: 12, ExpYear: 2025}, date(2026, time.January)},
+		{"missing month", &stripe.PaymentMethodCard{ExpYear: 2025}, nil},
+		{"missing year", &stripe.PaymentMethodCard{ExpMonth: 6}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := convertPaymentMethod(&stripe.PaymentMethod{ID: "pm_1", Type: stripe.PaymentMethodTypeCard, Card: tt.card}, 1)
+			switch {
+			case tt.want == nil && pm.ExpiresAt != nil:
+				t.Errorf("ExpiresAt = %v, want nil", pm.ExpiresAt)
+			case tt.want != nil && (pm.ExpiresAt == nil || !pm.ExpiresAt.Equal(*tt.want)):
+				t.Errorf("ExpiresAt = %v, want %v", pm.ExpiresAt, tt.want)
+			}
+		})
+	}
+}
+
+func date(year int, month time.Month) *time.Time {
+	t := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return &t
+}
@@ -0,0 +1,527 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cristosal/orm"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/coupon"
+	"github.com/stripe/stripe-go/v74/promotioncode"
+	"github.com/stripe/stripe-go/v74/subscription"
+)
+
+var (
+	ErrInvalidCouponDiscount = errors.New("coupon needs either a percent off between 0 and 100 or an amount off with a currency")
+	ErrInvalidCouponDuration = errors.New("coupon duration must be once, forever or repeating for a number of months")
+	ErrInvalidDiscount       = errors.New("discount needs either a coupon or a promotion code")
+)
+
+// DiscountRequest applies a coupon, or the coupon of a promotion code, to a subscription
+type DiscountRequest struct {
+	SubscriptionID  int64
+	CouponID        int64
+	PromotionCodeID int64
+}
+
+// GetCouponByID returns the coupon with the given id
+func (r *Repo) GetCouponByID(id int64) (*Coupon, error) {
+	c := Coupon{ID: id}
+	if err := orm.GetByID(r.db, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// GetCouponByProvider returns the coupon with the given provider id
+func (r *Repo) GetCouponByProvider(provider, providerID string) (*Coupon, error) {
+	var c Coupon
+	if err := orm.Get(r.db, &c, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// ListCoupons returns every coupon, newest first
+func (r *Repo) ListCoupons() ([]Coupon, error) {
+	var coupons []Coupon
+	if err := orm.List(r.db, &coupons, "ORDER BY created_at DESC, id DESC"); err != nil {
+		return nil, err
+	}
+
+	return coupons, nil
+}
+
+// upsertCoupon adds the coupon or updates the one with the same provider id
+func (r *Repo) upsertCoupon(c *Coupon) error {
+	prev, err := r.GetCouponByProvider(c.Provider, c.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return orm.Add(r.db, c)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.ID = prev.ID
+	return orm.UpdateByID(r.db, c)
+}
+
+// invalidateCouponByProvider marks a coupon that was deleted in the provider as invalid.
+// Coupons are kept because subscriptions that were discounted before stay discounted.
+func (r *Repo) invalidateCouponByProvider(provider, providerID string) error {
+	sql := fmt.Sprintf("UPDATE %s SET valid = FALSE WHERE provider = $1 AND provider_id = $2", orm.TableName(&Coupon{}))
+	_, err := r.db.Exec(sql, provider, providerID)
+	return err
+}
+
+// invalidateCouponOrphans marks the coupons of the provider that are not in ids as invalid
+func (r *Repo) invalidateCouponOrphans(provider string, ids []string) error {
+	// a nil slice is sent as NULL, which would match no coupon
+	if ids == nil {
+		ids = []string{}
+	}
+
+	sql := fmt.Sprintf("UPDATE %s SET valid = FALSE WHERE provider = $1 AND NOT (provider_id = ANY($2))", orm.TableName(&Coupon{}))
+	_, err := r.db.Exec(sql, provider, ids)
+	return err
+}
+
+// deactivatePromotionCodeOrphans deactivates the promotion codes of the provider that are not in ids, so they can no longer be redeemed
+func (r *Repo) deactivatePromotionCodeOrphans(provider string, ids []string) error {
+	// a nil slice is sent as NULL, which would match no promotion code
+	if ids == nil {
+		ids = []string{}
+	}
+
+	sql := fmt.Sprintf("UPDATE %s SET active = FALSE WHERE provider = $1 AND NOT (provider_id = ANY($2))", orm.TableName(&PromotionCode{}))
+	_, err := r.db.Exec(sql, provider, ids)
+	return err
+}
+
+// GetPromotionCodeByID returns the promotion code with the given id
+func (r *Repo) GetPromotionCodeByID(id int64) (*PromotionCode, error) {
+	pc := PromotionCode{ID: id}
+	if err := orm.GetByID(r.db, &pc); err != nil {
+		return nil, err
+	}
+
+	return &pc, nil
+}
+
+// GetPromotionCodeByProvider returns the promotion code with the given provider id
+func (r *Repo) GetPromotionCodeByProvider(provider, providerID string) (*PromotionCode, error) {
+	var pc PromotionCode
+	if err := orm.Get(r.db, &pc, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &pc, nil
+}
+
+// ListPromotionCodes returns every promotion code, newest first
+func (r *Repo) ListPromotionCodes() ([]PromotionCode, error) {
+	var codes []PromotionCode
+	if err := orm.List(r.db, &codes, "ORDER BY created_at DESC, id DESC"); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// ListPromotionCodesByCouponID returns the promotion codes of a coupon, newest first
+func (r *Repo) ListPromotionCodesByCouponID(couponID int64) ([]PromotionCode, error) {
+	var codes []PromotionCode
+	if err := orm.List(r.db, &codes, "WHERE coupon_id = $1 ORDER BY created_at DESC, id DESC", couponID); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// upsertPromotionCode adds the promotion code or updates the one with the same provider id
+func (r *Repo) upsertPromotionCode(pc *PromotionCode) error {
+	prev, err := r.GetPromotionCodeByProvider(pc.Provider, pc.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return orm.Add(r.db, pc)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	pc.ID = prev.ID
+	return orm.UpdateByID(r.db, pc)
+}
+
+// AddCoupon creates a coupon in stripe and stores it.
+// A repeating coupon needs the number of months it discounts for.
+func (s *StripeProvider) AddCoupon(c *Coupon) error {
+	if err := validateCoupon(c); err != nil {
+		return err
+	}
+
+	params := &stripe.CouponParams{
+		Duration: stripe.String(c.Duration),
+	}
+
+	if c.Name != "" {
+		params.Name = stripe.String(c.Name)
+	}
+
+	if c.PercentOff > 0 {
+		params.PercentOff = stripe.Float64(c.PercentOff)
+	} else {
+		params.AmountOff = stripe.Int64(c.AmountOff)
+		params.Currency = stripe.String(strings.ToLower(c.Currency))
+	}
+
+	if c.Duration == CouponRepeating {
+		params.DurationInMonths = stripe.Int64(c.DurationInMonths)
+	}
+
+	if c.MaxRedemptions > 0 {
+		params.MaxRedemptions = stripe.Int64(c.MaxRedemptions)
+	}
+
+	if c.RedeemBy != nil {
+		params.RedeemBy = stripe.Int64(c.RedeemBy.Unix())
+	}
+
+	s.setIdempotencyKey(params)
+	sc, err := coupon.New(params)
+	if err != nil {
+		return err
+	}
+
+	created := convertCoupon(sc)
+	if err := s.upsertCoupon(created); err != nil {
+		return err
+	}
+
+	*c = *created
+	return nil
+}
+
+func validateCoupon(c *Coupon) error {
+	percent := c.PercentOff > 0 && c.PercentOff <= 100
+	amount := c.AmountOff > 0 && c.Currency != ""
+	if percent == amount || c.PercentOff < 0 || c.PercentOff > 100 || c.AmountOff < 0 {
+		return ErrInvalidCouponDiscount
+	}
+
+	switch c.Duration {
+	case CouponOnce, CouponForever:
+		return nil
+	case CouponRepeating:
+		if c.DurationInMonths > 0 {
+			return nil
+		}
+	}
+
+	return ErrInvalidCouponDuration
+}
+
+// AddPromotionCode creates a promotion code for a coupon in stripe and stores it.
+// Stripe generates the code when none is given.
+func (s *StripeProvider) AddPromotionCode(pc *PromotionCode) error {
+	c, err := s.GetCouponByID(pc.CouponID)
+	if err != nil {
+		return err
+	}
+
+	params := &stripe.PromotionCodeParams{
+		Coupon: stripe.String(c.ProviderID),
+		Active: stripe.Bool(true),
+	}
+
+	if code := strings.TrimSpace(pc.Code); code != "" {
+		params.Code = stripe.String(code)
+	}
+
+	if pc.CustomerID != nil {
+		cust, err := s.GetCustomerByID(*pc.CustomerID)
+		if err != nil {
+			return err
+		}
+
+		params.Customer = stripe.String(cust.ProviderID)
+	}
+
+	if pc.MaxRedemptions > 0 {
+		params.MaxRedemptions = stripe.Int64(pc.MaxRedemptions)
+	}
+
+	if pc.ExpiresAt != nil {
+		params.ExpiresAt = stripe.Int64(pc.ExpiresAt.Unix())
+	}
+
+	if pc.FirstTimeTransaction {
+		params.Restrictions = &stripe.PromotionCodeRestrictionsParams{
+			FirstTimeTransaction: stripe.Bool(true),
+		}
+	}
+
+	s.setIdempotencyKey(params)
+	spc, err := promotioncode.New(params)
+	if err != nil {
+		return err
+	}
+
+	created, err := s.convertPromotionCode(spc)
+	if err != nil {
+		return err
+	}
+
+	if err := s.upsertPromotionCode(created); err != nil {
+		return err
+	}
+
+	*pc = *created
+	return nil
+}
+
+// ApplySubscriptionDiscount discounts a subscription with a coupon or a promotion code, replacing its current discount.
+// The local copy is updated by the webhook.
+func (s *StripeProvider) ApplySubscriptionDiscount(req *DiscountRequest) error {
+	if (req.CouponID == 0) == (req.PromotionCodeID == 0) {
+		return ErrInvalidDiscount
+	}
+
+	sub, err := s.GetSubscriptionByID(req.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	params := &stripe.SubscriptionParams{}
+	if req.CouponID != 0 {
+		c, err := s.GetCouponByID(req.CouponID)
+		if err != nil {
+			return err
+		}
+
+		params.Coupon = stripe.String(c.ProviderID)
+	} else {
+		pc, err := s.GetPromotionCodeByID(req.PromotionCodeID)
+		if err != nil {
+			return err
+		}
+
+		params.PromotionCode = stripe.String(pc.ProviderID)
+	}
+
+	s.setIdempotencyKey(params)
+	_, err = subscription.Update(sub.ProviderID, params)
+	return err
+}
+
+// RemoveSubscriptionDiscount ends the discount of a subscription. The local copy is updated by the webhook
+func (s *StripeProvider) RemoveSubscriptionDiscount(subID int64) error {
+	sub, err := s.GetSubscriptionByID(subID)
+	if err != nil {
+		return err
+	}
+
+	params := &stripe.SubscriptionDeleteDiscountParams{}
+	s.setIdempotencyKey(params)
+	_, err = subscription.DeleteDiscount(sub.ProviderID, params)
+	return err
+}
+
+func (s *StripeProvider) syncCoupons() error {
+	var ids []string
+	it := coupon.List(nil)
+	for it.Next() {
+		c := it.Coupon()
+		ids = append(ids, c.ID)
+		if err := s.upsertCoupon(convertCoupon(c)); err != nil {
+			log.Printf("error syncing coupon %s: %v", c.ID, err)
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return s.invalidateCouponOrphans(ProviderStripe, ids)
+}
+
+func (s *StripeProvider) syncPromotionCodes() error {
+	var ids []string
+	it := promotioncode.List(nil)
+	for it.Next() {
+		spc := it.PromotionCode()
+		ids = append(ids, spc.ID)
+		pc, err := s.convertPromotionCode(spc)
+		if err != nil {
+			log.Printf("error converting promotion code %s: %v", spc.ID, err)
+			continue
+		}
+
+		if err := s.upsertPromotionCode(pc); err != nil {
+			log.Printf("error syncing promotion code %s: %v", spc.ID, err)
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return s.deactivatePromotionCodeOrphans(ProviderStripe, ids)
+}
+
+func convertCoupon(c *stripe.Coupon) *Coupon {
+	var redeemBy *time.Time
+	if c.RedeemBy != 0 {
+		t := time.Unix(c.RedeemBy, 0)
+		redeemBy = &t
+	}
+
+	return &Coupon{
+		Provider:         ProviderStripe,
+		ProviderID:       c.ID,
+		Name:             c.Name,
+		PercentOff:       c.PercentOff,
+		AmountOff:        c.AmountOff,
+		Currency:         string(c.Currency),
+		Duration:         string(c.Duration),
+		DurationInMonths: c.DurationInMonths,
+		MaxRedemptions:   c.MaxRedemptions,
+		TimesRedeemed:    c.TimesRedeemed,
+		RedeemBy:         redeemBy,
+		Valid:            c.Valid && !c.Deleted,
+		CreatedAt:        time.Unix(c.Created, 0),
+	}
+}
+
+// couponID returns the local id of a stripe coupon, storing coupons that were not synced yet
+func (s *StripeProvider) couponID(c *stripe.Coupon) (int64, error) {
+	found, err := s.GetCouponByProvider(ProviderStripe, c.ID)
+	if err == nil {
+		return found.ID, nil
+	}
+
+	if !errors.Is(err, orm.ErrNotFound) {
+		return 0, err
+	}
+
+	// coupons are only referenced by id when they are not expanded
+	if c.Duration == "" {
+		if c, err = coupon.Get(c.ID, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	stored := convertCoupon(c)
+	if err := s.upsertCoupon(stored); err != nil {
+		return 0, err
+	}
+
+	return stored.ID, nil
+}
+
+// promotionCodeID returns the local id of a stripe promotion code, storing codes that were not synced yet
+func (s *StripeProvider) promotionCodeID(providerID string) (int64, error) {
+	found, err := s.GetPromotionCodeByProvider(ProviderStripe, providerID)
+	if err == nil {
+		return found.ID, nil
+	}
+
+	if !errors.Is(err, orm.ErrNotFound) {
+		return 0, err
+	}
+
+	spc, err := promotioncode.Get(providerID, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	pc, err := s.convertPromotionCode(spc)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.upsertPromotionCode(pc); err != nil {
+		return 0, err
+	}
+
+	return pc.ID, nil
+}
+
+func (s *StripeProvider) convertPromotionCode(pc *stripe.PromotionCode) (*PromotionCode, error) {
+	if pc.Coupon == nil {
+		return nil, fmt.Errorf("promotion code %s has no coupon", pc.ID)
+	}
+
+	couponID, err := s.couponID(pc.Coupon)
+	if err != nil {
+		return nil, fmt.Errorf("could not get coupon %s of promotion code %s: %w", pc.Coupon.ID, pc.ID, err)
+	}
+
+	code := PromotionCode{
+		CouponID:       couponID,
+		Provider:       ProviderStripe,
+		ProviderID:     pc.ID,
+		Code:           pc.Code,
+		Active:         pc.Active,
+		MaxRedemptions: pc.MaxRedemptions,
+		TimesRedeemed:  pc.TimesRedeemed,
+		ExpiresAt:      convertTimestamp(pc.ExpiresAt),
+		CreatedAt:      time.Unix(pc.Created, 0),
+	}
+
+	if pc.Restrictions != nil {
+		code.FirstTimeTransaction = pc.Restrictions.FirstTimeTransaction
+	}
+
+	if pc.Customer != nil {
+		cust, err := s.GetCustomerByProvider(ProviderStripe, pc.Customer.ID)
+		if err != nil {
+			return nil, fmt.Errorf("could not get customer %s of promotion code %s: %w", pc.Customer.ID, pc.ID, err)
+		}
+
+		code.CustomerID = &cust.ID
+	}
+
+	return &code, nil
+}
+
+// convertDiscount sets the coupon and promotion code of the subscription discount
+func (s *StripeProvider) convertDiscount(sub *Subscription, d *stripe.Discount) error {
+	if d == nil || d.Coupon == nil {
+		return nil
+	}
+
+	couponID, err := s.couponID(d.Coupon)
+	if err != nil {
+		return fmt.Errorf("could not get coupon %s: %w", d.Coupon.ID, err)
+	}
+
+	sub.CouponID = &couponID
+	sub.DiscountEnd = convertTimestamp(d.End)
+	if d.PromotionCode == nil {
+		return nil
+	}
+
+	codeID, err := s.promotionCodeID(d.PromotionCode.ID)
+	if err != nil {
+		return fmt.Errorf("could not get promotion code %s: %w", d.PromotionCode.ID, err)
+	}
+
+	sub.PromotionCodeID = &codeID
+	return nil
+}
+
+// sameID is true when both ids are unset or equal
+func sameID(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
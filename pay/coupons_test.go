@@ -0,0 +1,35 @@
+package pay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateCoupon(t *testing.T) {
+	tests := []struct {
+		name    string
+		coupon  Coupon
+		wantErr error
+	}{
+		{"percent off once", Coupon{PercentOff: 25, Duration: CouponOnce}, nil},
+		{"full percent off forever", Coupon{PercentOff: 100, Duration: CouponForever}, nil},
+		{"amount off repeating", Coupon{AmountOff: 500, Currency: "usd", Duration: CouponRepeating, DurationInMonths: 3}, nil},
+		{"no discount", Coupon{Duration: CouponOnce}, ErrInvalidCouponDiscount},
+		{"percent and amount off", Coupon{PercentOff: 10, AmountOff: 500, Currency: "usd", Duration: CouponOnce}, ErrInvalidCouponDiscount},
+		{"percent off over 100", Coupon{PercentOff: 101, Duration: CouponOnce}, ErrInvalidCouponDiscount},
+		{"negative percent off", Coupon{PercentOff: -5, AmountOff: 500, Currency: "usd", Duration: CouponOnce}, ErrInvalidCouponDiscount},
+		{"amount off without currency", Coupon{AmountOff: 500, Duration: CouponOnce}, ErrInvalidCouponDiscount},
+		{"negative amount off", Coupon{PercentOff: 10, AmountOff: -500, Duration: CouponOnce}, ErrInvalidCouponDiscount},
+		{"repeating without months", Coupon{PercentOff: 10, Duration: CouponRepeating}, ErrInvalidCouponDuration},
+		{"missing duration", Coupon{PercentOff: 10}, ErrInvalidCouponDuration},
+		{"unknown duration", Coupon{PercentOff: 10, Duration: "weekly"}, ErrInvalidCouponDuration},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateCoupon(&tt.coupon); !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateCoupon() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package pay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cristosal/orm"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/subscription"
+)
+
+type (
+	// DunningPolicy decides how long subscriptions keep access after their renewal payment fails.
+	// The zero policy deactivates subscriptions as soon as they are past due.
+	DunningPolicy struct {
+		GraceDays    int   // days a past due subscription stays active after its first failed payment
+		ReminderDays []int // days before the grace period ends that grace expiring events are published
+	}
+
+	// PaymentFailure is a failed payment of a subscription invoice
+	PaymentFailure struct {
+		Subscription       Subscription
+		InvoiceID          string // provider id of the invoice that could not be paid
+		AmountDue          int64
+		Currency           string
+		AttemptCount       int64
+		NextPaymentAttempt *time.Time // when the provider retries the payment, nil after the last attempt
+	}
+)
+
+// gracePeriod is how long past due subscriptions keep access
+func (p DunningPolicy) gracePeriod() time.Duration {
+	if p.GraceDays <= 0 {
+		return 0
+	}
+
+	return time.Duration(p.GraceDays) * 24 * time.Hour
+}
+
+// reminderDue returns when the latest grace expiring reminder of the subscription was due,
+// or false when none is due yet. Reminders that fall before the payment failed are skipped.
+func (p DunningPolicy) reminderDue(s *Subscription, now time.Time) (time.Time, bool) {
+	var (
+		due   time.Time
+		found bool
+	)
+
+	for _, days := range p.ReminderDays {
+		at := s.GraceEnd.Add(-time.Duration(days) * 24 * time.Hour)
+		if at.After(now) || at.Before(*s.PaymentFailedAt) {
+			continue
+		}
+
+		if !found || at.After(due) {
+			due = at
+			found = true
+		}
+	}
+
+	return due, found
+}
+
+// pastDue is true when the renewal of a subscription could not be paid
+func pastDue(s *Subscription) bool {
+	return s.Status == SubscriptionStatusPastDue || s.Status == SubscriptionStatusUnpaid
+}
+
+// applyDunning keeps past due subscriptions active until their grace period ends.
+// The grace period starts when the subscription is first seen past due and is cleared once it is paid.
+func (s *StripeProvider) applyDunning(sub *Subscription) error {
+	if !pastDue(sub) {
+		sub.PaymentFailedAt = nil
+		sub.GraceEnd = nil
+		sub.GraceRemindedAt = nil
+		return nil
+	}
+
+	var prev Subscription
+	err := orm.Get(s.db, &prev, "WHERE provider = $1 AND provider_id = $2", sub.Provider, sub.ProviderID)
+	if err != nil && !errors.Is(err, orm.ErrNotFound) {
+		return err
+	}
+
+	now := time.Now()
+	if err == nil && prev.PaymentFailedAt != nil {
+		sub.PaymentFailedAt = prev.PaymentFailedAt
+		sub.GraceEnd = prev.GraceEnd
+		sub.GraceRemindedAt = prev.GraceRemindedAt
+	} else {
+		end := now.Add(s.config.Dunning.gracePeriod())
+		sub.PaymentFailedAt = &now
+		sub.GraceEnd = &end
+	}
+
+	sub.Active = now.Before(*sub.GraceEnd)
+	return nil
+}
+
+// ExpireGracePeriods deactivates past due subscriptions whose grace period has ended and returns them
+func (s *StripeProvider) ExpireGracePeriods() ([]Subscription, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var sub Subscription
+	sql := fmt.Sprintf("UPDATE %s SET active = FALSE WHERE active AND grace_end <= NOW() RETURNING %s",
+		sub.TableName(),
+		orm.Columns(&sub).List(),
+	)
+
+	var expired []Subscription
+	if err := orm.Query(tx, &expired, sql); err != nil {
+		return nil, err
+	}
+
+	for i := range expired {
+		src := historySource{Event: SourceGracePeriod, At: *expired[i].GraceEnd}
+		if err := addSubscriptionHistory(tx, &expired[i], SubscriptionDeactivated, src); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadSubscriptionItems(expired); err != nil {
+		return nil, err
+	}
+
+	for i := range expired {
+		prev := expired[i]
+		prev.Active = true
+		s.subUpdated(&prev, &expired[i])
+	}
+
+	return expired, nil
+}
+
+// RemindGracePeriods publishes a grace expiring event for every past due subscription that reached a reminder of the dunning policy.
+// Only the latest reminder that is due is published, so reminders missed while cent was down are not sent at once.
+func (s *StripeProvider) RemindGracePeriods() ([]Subscription, error) {
+	if len(s.config.Dunning.ReminderDays) == 0 {
+		return nil, nil
+	}
+
+	var subs []Subscription
+	if err := orm.List(s.db, &subs, "WHERE active AND grace_end > NOW() AND payment_failed_at IS NOT NULL"); err != nil {
+		return nil, err
+	}
+
+	var (
+		now      = time.Now()
+		reminded []Subscription
+	)
+
+	for i := range subs {
+		sub := &subs[i]
+		due, ok := s.config.Dunning.reminderDue(sub, now)
+		if !ok || (sub.GraceRemindedAt != nil && !sub.GraceRemindedAt.Before(due)) {
+			continue
+		}
+
+		// the condition keeps concurrent instances from publishing the same reminder twice
+		sql := fmt.Sprintf("UPDATE %s SET grace_reminded_at = $1 WHERE id = $2 AND (grace_reminded_at IS NULL OR grace_reminded_at < $3)", sub.TableName())
+		res, err := s.db.Exec(sql, now, sub.ID, due)
+		if err != nil {
+			return nil, err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+
+		sub.GraceRemindedAt = &now
+		reminded = append(reminded, *sub)
+	}
+
+	if err := s.loadSubscriptionItems(reminded); err != nil {
+		return nil, err
+	}
+
+	for i := range reminded {
+		s.graceExpiring(&reminded[i])
+	}
+
+	return reminded, nil
+}
+
+// handleInvoicePaymentFailed starts the grace period of the subscription the invoice belongs to and publishes the failure.
+// The subscription is fetched from stripe because its update event may arrive after the failed payment.
+func (s *StripeProvider) handleInvoicePaymentFailed(event *stripe.Event) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+		return err
+	}
+
+	// first payments of new subscriptions leave them incomplete and are handled by checkout
+	if inv.Subscription == nil || inv.BillingReason == stripe.InvoiceBillingReasonSubscriptionCreate {
+		return nil
+	}
+
+	ss, err := subscription.Get(inv.Subscription.ID, nil)
+	if err != nil {
+		return err
+	}
+
+	sub, err := s.convertSubscription(ss)
+	if err != nil {
+		return err
+	}
+
+	if err := s.updateSubscriptionByProvider(sub, eventSource(event)); err != nil {
+		return err
+	}
+
+	s.paymentFailed(&PaymentFailure{
+		Subscription:       *sub,
+		InvoiceID:          inv.ID,
+		AmountDue:          inv.AmountDue,
+		Currency:           string(inv.Currency),
+		AttemptCount:       inv.AttemptCount,
+		NextPaymentAttempt: convertTimestamp(inv.NextPaymentAttempt),
+	})
+
+	return nil
+}
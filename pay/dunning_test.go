@@ -0,0 +1,56 @@
+package pay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDunningPolicyGracePeriod(t *testing.T) {
+	tests := []struct {
+		days int
+		want time.Duration
+	}{
+		{0, 0},
+		{-3, 0},
+		{1, 24 * time.Hour},
+		{7, 7 * 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := (DunningPolicy{GraceDays: tt.days}).gracePeriod(); got != tt.want {
+			t.Errorf("gracePeriod() with %d days = %v, want %v", tt.days, got, tt.want)
+		}
+	}
+}
+
+func TestDunningPolicyReminderDue(t *testing.T) {
+	day := 24 * time.Hour
+	failed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	end := failed.Add(7 * day)
+	sub := &Subscription{PaymentFailedAt: &failed, GraceEnd: &end}
+
+	tests := []struct {
+		name    string
+		days    []int
+		now     time.Time
+		want    time.Time
+		wantDue bool
+	}{
+		{"no reminders", nil, end.Add(-day), time.Time{}, false},
+		{"before the first reminder", []int{3, 1}, end.Add(-4 * day), time.Time{}, false},
+		{"first reminder", []int{3, 1}, end.Add(-3 * day), end.Add(-3 * day), true},
+		{"latest of several due reminders", []int{3, 1}, end.Add(-time.Hour), end.Add(-day), true},
+		{"order of days does not matter", []int{1, 3}, end.Add(-time.Hour), end.Add(-day), true},
+		{"reminder before the payment failed is skipped", []int{10}, end.Add(-time.Hour), time.Time{}, false},
+		{"reminder on the day the payment failed", []int{7}, failed, failed, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, due := DunningPolicy{GraceDays: 7, ReminderDays: tt.days}.reminderDue(sub, tt.now)
+			if due != tt.wantDue || !got.Equal(tt.want) {
+				t.Errorf("reminderDue() = %v, %v, want %v, %v", got, due, tt.want, tt.wantDue)
+			}
+		})
+	}
+}
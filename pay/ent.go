@@ -1,6 +1,9 @@
 package pay
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -12,6 +15,38 @@ const (
 	PricingOnce    PricingSchedule = "once"
 )
 
+// Metadata is a set of key value pairs attached to an entity, stored as a json object
+type Metadata map[string]string
+
+// Value implements driver.Valuer
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+// Scan implements sql.Scanner
+func (m *Metadata) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*m = Metadata{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, m)
+	case string:
+		return json.Unmarshal([]byte(v), m)
+	default:
+		return fmt.Errorf("unable to scan %T into metadata", src)
+	}
+}
+
 type Price struct {
 	ID         int64
 	PlanID     int64
@@ -21,6 +56,10 @@ type Price struct {
 	Currency   string
 	Schedule   PricingSchedule
 	TrialDays  int
+	Active     bool
+	Nickname   string
+	Metadata   Metadata
+	Meter      string // metered prices bill the usage recorded for this meter, empty for licensed prices
 }
 
 func (p *Price) TableName() string {
@@ -44,12 +83,25 @@ type Plan struct {
 	Provider    string
 	ProviderID  string
 	Active      bool
+	MaxSeats    int64 // users per subscription, zero when seats are bought as subscription quantity
 }
 
 func (p *Plan) TableName() string {
 	return "pay.plan"
 }
 
+// Entitlement is a feature granted by a plan. Features with a limit grant up to that amount, others are simply enabled
+type Entitlement struct {
+	ID      int64
+	PlanID  int64
+	Feature string
+	Limit   *int64 `db:"limit_value"`
+}
+
+func (Entitlement) TableName() string {
+	return "pay.plan_entitlement"
+}
+
 // Customer from a provider like stripe or paypal
 type Customer struct {
 	ID         int64  // internal (to this service)
@@ -63,19 +115,133 @@ func (c *Customer) TableName() string {
 	return "pay.customer"
 }
 
+// SubscriptionStatus is the status of a subscription at the provider
+type SubscriptionStatus = string
+
+const (
+	SubscriptionStatusTrialing   SubscriptionStatus = "trialing"
+	SubscriptionStatusActive     SubscriptionStatus = "active"
+	SubscriptionStatusPastDue    SubscriptionStatus = "past_due"
+	SubscriptionStatusUnpaid     SubscriptionStatus = "unpaid"
+	SubscriptionStatusCanceled   SubscriptionStatus = "canceled"
+	SubscriptionStatusIncomplete SubscriptionStatus = "incomplete"
+	SubscriptionStatusExpired    SubscriptionStatus = "incomplete_expired"
+	SubscriptionStatusPaused     SubscriptionStatus = "paused"
+)
+
 // Subscription represents a customers subscription to a Plan
 type Subscription struct {
+	ID                 int64
+	Provider           string
+	ProviderID         string
+	CustomerID         int64
+	PriceID            int64
+	Active             bool // true when the status is active or trialing
+	CreatedAt          time.Time
+	Status             SubscriptionStatus
+	CurrentPeriodStart time.Time
+	CurrentPeriodEnd   time.Time
+	TrialEnd           *time.Time
+	CancelAt           *time.Time // when the subscription is scheduled to be canceled
+	CancelAtPeriodEnd  bool
+	CanceledAt         *time.Time
+	Quantity           int64
+	CollectionPaused   bool               // payment collection is paused and invoices are voided
+	CouponID           *int64             // coupon discounting the subscription
+	PromotionCodeID    *int64             // promotion code the coupon was redeemed with
+	DiscountEnd        *time.Time         // when a repeating discount stops
+	PaymentFailedAt    *time.Time         // when the renewal payment of a past due subscription first failed
+	GraceEnd           *time.Time         // when a past due subscription loses access
+	GraceRemindedAt    *time.Time         // when the last grace expiring reminder was published
+	Items              []SubscriptionItem `db:"-"` // every price of the subscription, the first is the one in PriceID
+}
+
+func (s *Subscription) TableName() string {
+	return "pay.subscription"
+}
+
+// SubscriptionItem is a price that a subscription is billed for
+type SubscriptionItem struct {
+	ID             int64
+	SubscriptionID int64
+	Provider       string
+	ProviderID     string
+	PriceID        int64
+	Quantity       int64
+}
+
+func (SubscriptionItem) TableName() string {
+	return "pay.subscription_item"
+}
+
+// Renews is true when the subscription will be renewed at the end of the current period
+func (s *Subscription) Renews() bool {
+	return s.Active && !s.CancelAtPeriodEnd && s.CancelAt == nil
+}
+
+// SubscriptionChange is the kind of state transition recorded in the subscription history
+type SubscriptionChange = string
+
+const (
+	SubscriptionCreated       SubscriptionChange = "created"
+	SubscriptionActivated     SubscriptionChange = "activated"
+	SubscriptionDeactivated   SubscriptionChange = "deactivated"
+	SubscriptionStatusChanged SubscriptionChange = "status_changed"
+	SubscriptionPriceChanged  SubscriptionChange = "price_changed"
+	SubscriptionChanged       SubscriptionChange = "updated"
+	SubscriptionDeleted       SubscriptionChange = "deleted"
+)
+
+// SubscriptionHistory is the state of a subscription after a transition.
+// History is append only and is kept after the subscription itself is removed.
+type SubscriptionHistory struct {
+	ID             int64
+	SubscriptionID int64
+	Provider       string
+	ProviderID     string
+	CustomerID     int64
+	PriceID        int64
+	Active         bool
+	Status         SubscriptionStatus
+	Quantity       int64
+	TrialEnd       *time.Time // end of the trial of the subscription at the time of the change
+	Change         SubscriptionChange
+	Source         string    // id of the provider event that caused the change, or sync
+	ChangedAt      time.Time // when the change happened at the provider
+	RecordedAt     time.Time // when the change was stored
+}
+
+func (SubscriptionHistory) TableName() string {
+	return "pay.subscription_history"
+}
+
+// Invoice issued to a customer. Invoices are not stored and are always fetched from the provider
+type Invoice struct {
+	ProviderID string
+	Number     string
+	Status     string
+	Currency   string
+	Total      int64
+	AmountDue  int64
+	AmountPaid int64
+	URL        string // hosted page where the customer can view and pay the invoice
+	CreatedAt  time.Time
+}
+
+// Payment is a completed one-time purchase of a price, such as a lifetime licence or a credit pack
+type Payment struct {
 	ID         int64
 	Provider   string
-	ProviderID string
-	CustomerID int64
-	PriceID    int64
-	Active     bool
+	ProviderID string // id of the payment intent at the provider
+	CustomerID *int64 // nil once the customer was removed
+	PriceID    *int64 // nil when the payment was not made through a checkout for a price, or once the price was removed
+	Amount     int64
+	Currency   string
 	CreatedAt  time.Time
 }
 
-func (s *Subscription) TableName() string {
-	return "pay.subscription"
+func (Payment) TableName() string {
+	return "pay.payment"
 }
 
 type WebhookEvent struct {
@@ -90,11 +256,159 @@ func (e *WebhookEvent) TableName() string {
 	return "pay.webhook_event"
 }
 
+// SeatRole is what a user attached to a subscription can do with its seats
+type SeatRole = string
+
+const (
+	SeatOwner  SeatRole = "owner"  // manages every seat, including owners
+	SeatAdmin  SeatRole = "admin"  // manages admin and member seats
+	SeatMember SeatRole = "member" // takes a seat
+)
+
 type SubscriptionUser struct {
 	SubscriptionID int64
 	Username       string
+	Role           SeatRole // defaults to member
+	Actor          string   `db:"-"`          // user making the change, which must be an owner or admin unless the change is made by the system
+	System         bool     `db:"-" json:"-"` // made by cent itself, the web ui or an admin api token, which skips the seat rules
 }
 
 func (SubscriptionUser) TableName() string {
 	return "pay.subscription_user"
 }
+
+// InviteStatus is the state of a subscription invite
+type InviteStatus = string
+
+const (
+	InvitePending  InviteStatus = "pending"
+	InviteAccepted InviteStatus = "accepted"
+	InviteRevoked  InviteStatus = "revoked"
+	InviteExpired  InviteStatus = "expired"
+)
+
+// SubscriptionInvite invites an email to take a seat of a subscription
+type SubscriptionInvite struct {
+	ID             int64
+	SubscriptionID int64
+	Email          string
+	InvitedBy      string // username of who sent the invite
+	Status         InviteStatus
+	Username       string // who accepted the invite
+	ExpiresAt      time.Time
+	CreatedAt      time.Time
+	AcceptedAt     *time.Time
+	Token          string `db:"-"` // signed token for accepting the invite, only set when the invite is sent
+}
+
+func (SubscriptionInvite) TableName() string {
+	return "pay.subscription_invite"
+}
+
+// PaymentMethod is a way of paying saved for a customer, such as a card
+type PaymentMethod struct {
+	ID               int64
+	CustomerID       int64
+	Provider         string
+	ProviderID       string
+	Type             string
+	Brand            string // card brand like visa or mastercard
+	Last4            string
+	ExpMonth         int64
+	ExpYear          int64
+	ExpiresAt        *time.Time // when a card stops working, the start of the month after its expiry
+	IsDefault        bool       // used for the invoices of the customer
+	CreatedAt        time.Time
+	ExpiryNotifiedAt *time.Time // when the card expiring event was published
+}
+
+func (PaymentMethod) TableName() string {
+	return "pay.payment_method"
+}
+
+// CouponDuration is how long a coupon discounts a subscription
+type CouponDuration = string
+
+const (
+	CouponOnce      CouponDuration = "once"
+	CouponRepeating CouponDuration = "repeating"
+	CouponForever   CouponDuration = "forever"
+)
+
+// Coupon is a percent or amount off discount that can be applied to subscriptions
+type Coupon struct {
+	ID               int64
+	Provider         string
+	ProviderID       string
+	Name             string
+	PercentOff       float64
+	AmountOff        int64 // in the smallest unit of Currency
+	Currency         string
+	Duration         CouponDuration
+	DurationInMonths int64 // months a repeating coupon discounts for
+	MaxRedemptions   int64 // zero when unlimited
+	TimesRedeemed    int64
+	RedeemBy         *time.Time
+	Valid            bool // false once the coupon can no longer be redeemed or was deleted in the provider
+	CreatedAt        time.Time
+}
+
+func (Coupon) TableName() string {
+	return "pay.coupon"
+}
+
+// PromotionCode is a code that customers enter to redeem a coupon
+type PromotionCode struct {
+	ID                   int64
+	CouponID             int64
+	Provider             string
+	ProviderID           string
+	Code                 string
+	Active               bool
+	CustomerID           *int64 // only this customer can redeem the code when set
+	MaxRedemptions       int64  // zero when unlimited
+	TimesRedeemed        int64
+	ExpiresAt            *time.Time
+	FirstTimeTransaction bool // only customers that never paid can redeem the code
+	CreatedAt            time.Time
+}
+
+func (PromotionCode) TableName() string {
+	return "pay.promotion_code"
+}
+
+// UsageRecord is usage of a meter by a subscription.
+// Records are buffered until they are reported to the provider in batches.
+type UsageRecord struct {
+	ID                 int64
+	SubscriptionID     int64
+	SubscriptionItemID int64  // item of the subscription billed for the meter
+	Username           string // user that was recorded against, empty when recorded by subscription
+	Meter              string
+	Quantity           int64
+	Timestamp          time.Time
+	IdempotencyKey     string
+	CreatedAt          time.Time
+	ReportingBatch     string     // batch the record was claimed for, empty until it is claimed for reporting
+	ClaimedAt          *time.Time // when the record was claimed for reporting
+	ReportAttempts     int        // times the record was claimed for reporting
+	ReportedAt         *time.Time // nil until the record is reported
+	Error              string     // why the record could not be reported
+}
+
+func (UsageRecord) TableName() string {
+	return "pay.usage_record"
+}
+
+// IdempotentRequest stores the response to a request that was made with an idempotency key
+type IdempotentRequest struct {
+	ID        int64
+	Key       string
+	Subject   string
+	Response  []byte
+	CreatedAt time.Time
+}
+
+func (IdempotentRequest) TableName() string {
+	return "pay.idempotent_request"
+}
@@ -0,0 +1,247 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cristosal/orm"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/product"
+)
+
+// MetadataFeaturePrefix prefixes the product metadata keys holding the entitlements of a plan.
+// A value of true enables the feature, false leaves it out and a number sets its limit.
+const MetadataFeaturePrefix = "cent_feature_"
+
+var (
+	ErrFeatureRequired  = errors.New("feature is required")
+	ErrDuplicateFeature = errors.New("feature is granted more than once")
+	ErrInvalidLimit     = errors.New("limit must be zero or more")
+)
+
+type (
+	// UserEntitlement is a feature granted to a user by the plans of its active subscriptions
+	UserEntitlement struct {
+		Username string
+		Feature  string
+		Enabled  bool
+		Limit    *int64 // highest limit of the plans granting the feature, nil when any of them leaves it unlimited
+	}
+
+	// EntitlementCheck asks whether a user has a feature
+	EntitlementCheck struct {
+		Username string
+		Feature  string
+	}
+
+	// SetEntitlementsRequest replaces the entitlements of a plan
+	SetEntitlementsRequest struct {
+		PlanID       int64
+		Entitlements []Entitlement
+	}
+)
+
+// ListPlanEntitlements returns the features granted by a plan
+func (r *Repo) ListPlanEntitlements(planID int64) ([]Entitlement, error) {
+	var ents []Entitlement
+	if err := orm.List(r.db, &ents, "WHERE plan_id = $1 ORDER BY feature", planID); err != nil {
+		return nil, err
+	}
+
+	return ents, nil
+}
+
+// cleanEntitlements trims the features of the entitlements and checks that each names a distinct feature with a limit that is not negative
+func cleanEntitlements(ents []Entitlement) error {
+	seen := make(map[string]bool, len(ents))
+	for i := range ents {
+		ents[i].Feature = strings.TrimSpace(ents[i].Feature)
+		if ents[i].Feature == "" {
+			return ErrFeatureRequired
+		}
+
+		if seen[ents[i].Feature] {
+			return fmt.Errorf("%w: %s", ErrDuplicateFeature, ents[i].Feature)
+		}
+
+		if ents[i].Limit != nil && *ents[i].Limit < 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidLimit, ents[i].Feature)
+		}
+
+		seen[ents[i].Feature] = true
+	}
+
+	return nil
+}
+
+// SetPlanEntitlements replaces the features granted by a plan in the local database
+func (r *Repo) SetPlanEntitlements(planID int64, ents []Entitlement) error {
+	if err := cleanEntitlements(ents); err != nil {
+		return err
+	}
+
+	if _, err := r.GetPlanByID(planID); err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := orm.Remove(tx, &Entitlement{}, "WHERE plan_id = $1", planID); err != nil {
+		return err
+	}
+
+	for i := range ents {
+		ents[i].PlanID = planID
+		if err := orm.Add(tx, &ents[i]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListEntitlementsByUsername returns the features granted to a user by the plans of its active subscriptions
+func (r *Repo) ListEntitlementsByUsername(username string) ([]UserEntitlement, error) {
+	sql := fmt.Sprintf(`
+		SELECT su.username, e.feature, TRUE, CASE WHEN bool_or(e.limit_value IS NULL) THEN NULL ELSE MAX(e.limit_value) END
+		FROM %s e
+		INNER JOIN %s pr ON pr.plan_id = e.plan_id
+		INNER JOIN %s si ON si.price_id = pr.id
+		INNER JOIN %s s ON s.id = si.subscription_id AND s.active
+		INNER JOIN %s su ON su.subscription_id = s.id AND su.username = $1
+		GROUP BY su.username, e.feature
+		ORDER BY e.feature`,
+		orm.TableName(&Entitlement{}),
+		orm.TableName(&Price{}),
+		orm.TableName(&SubscriptionItem{}),
+		orm.TableName(&Subscription{}),
+		orm.TableName(&SubscriptionUser{}),
+	)
+
+	var ents []UserEntitlement
+	if err := orm.Query(r.db, &ents, sql, username); err != nil {
+		return nil, err
+	}
+
+	return ents, nil
+}
+
+// CheckEntitlement returns whether a user has a feature and its limit
+func (r *Repo) CheckEntitlement(check *EntitlementCheck) (*UserEntitlement, error) {
+	if check.Feature == "" {
+		return nil, ErrFeatureRequired
+	}
+
+	ents, err := r.ListEntitlementsByUsername(check.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ents {
+		if ents[i].Feature == check.Feature {
+			return &ents[i], nil
+		}
+	}
+
+	return &UserEntitlement{Username: check.Username, Feature: check.Feature}, nil
+}
+
+// productEntitlements reads the entitlements from the metadata of a product.
+// The second return value is false when the product has no feature metadata.
+func productEntitlements(p *stripe.Product) ([]Entitlement, bool) {
+	var (
+		ents  []Entitlement
+		found bool
+	)
+
+	for key, val := range p.Metadata {
+		feature, ok := strings.CutPrefix(key, MetadataFeaturePrefix)
+		if !ok || feature == "" {
+			continue
+		}
+
+		found = true
+		switch val = strings.TrimSpace(val); val {
+		case "true":
+			ents = append(ents, Entitlement{Feature: feature})
+		case "false", "":
+		default:
+			limit, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || limit < 0 {
+				log.Printf("ignoring feature %s of product %s: invalid value %q", feature, p.ID, val)
+				continue
+			}
+
+			ents = append(ents, Entitlement{Feature: feature, Limit: &limit})
+		}
+	}
+
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Feature < ents[j].Feature })
+	return ents, found
+}
+
+// syncProductEntitlements stores the entitlements in the metadata of a product as the entitlements of its plan.
+// Plans of products without feature metadata keep the entitlements that were set locally.
+func (s *StripeProvider) syncProductEntitlements(p *stripe.Product) error {
+	ents, found := productEntitlements(p)
+	if !found {
+		return nil
+	}
+
+	pl, err := s.GetPlanByProviderID(ProviderStripe, p.ID)
+	if err != nil {
+		return err
+	}
+
+	return s.Repo.SetPlanEntitlements(pl.ID, ents)
+}
+
+// SetPlanEntitlements writes the entitlements to the feature metadata of the stripe product of the plan and stores them.
+// Keeping them in the product means that syncing the product later stores the same entitlements instead of overwriting them.
+func (s *StripeProvider) SetPlanEntitlements(planID int64, ents []Entitlement) error {
+	if err := cleanEntitlements(ents); err != nil {
+		return err
+	}
+
+	pl, err := s.GetPlanByID(planID)
+	if err != nil {
+		return err
+	}
+
+	prod, err := product.Get(pl.ProviderID, nil)
+	if err != nil {
+		return err
+	}
+
+	// an empty value removes the key from the product
+	params := &stripe.ProductParams{}
+	for key := range prod.Metadata {
+		if strings.HasPrefix(key, MetadataFeaturePrefix) {
+			params.AddMetadata(key, "")
+		}
+	}
+
+	for _, e := range ents {
+		val := "true"
+		if e.Limit != nil {
+			val = strconv.FormatInt(*e.Limit, 10)
+		}
+
+		params.AddMetadata(MetadataFeaturePrefix+e.Feature, val)
+	}
+
+	if _, err := product.Update(pl.ProviderID, params); err != nil {
+		return err
+	}
+
+	return s.Repo.SetPlanEntitlements(planID, ents)
+}
@@ -0,0 +1,83 @@
+package pay
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+func limit(n int64) *int64 {
+	return &n
+}
+
+func TestCleanEntitlements(t *testing.T) {
+	tests := []struct {
+		name    string
+		ents    []Entitlement
+		want    []Entitlement
+		wantErr error
+	}{
+		{"none", nil, nil, nil},
+		{
+			"trims features",
+			[]Entitlement{{Feature: " sso "}, {Feature: "projects", Limit: limit(10)}},
+			[]Entitlement{{Feature: "sso"}, {Feature: "projects", Limit: limit(10)}},
+			nil,
+		},
+		{"zero limit", []Entitlement{{Feature: "seats", Limit: limit(0)}}, []Entitlement{{Feature: "seats", Limit: limit(0)}}, nil},
+		{"empty feature", []Entitlement{{Feature: "  "}}, nil, ErrFeatureRequired},
+		{"duplicate feature", []Entitlement{{Feature: "sso"}, {Feature: " sso"}}, nil, ErrDuplicateFeature},
+		{"negative limit", []Entitlement{{Feature: "projects", Limit: limit(-1)}}, nil, ErrInvalidLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := cleanEntitlements(tt.ents)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("cleanEntitlements() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err == nil && !reflect.DeepEqual(tt.ents, tt.want) {
+				t.Errorf("cleanEntitlements() = %+v, want %+v", tt.ents, tt.want)
+			}
+		})
+	}
+}
+
+func TestProductEntitlements(t *testing.T) {
+	tests := []struct {
+		name      string
+		metadata  map[string]string
+		want      []Entitlement
+		wantFound bool
+	}{
+		{"no metadata", nil, nil, false},
+		{"other metadata", map[string]string{MetadataMaxSeats: "5"}, nil, false},
+		{
+			"enabled and limited features sorted",
+			map[string]string{
+				MetadataFeaturePrefix + "sso":      "true",
+				MetadataFeaturePrefix + "projects": " 10 ",
+				MetadataMaxSeats:                   "5",
+			},
+			[]Entitlement{{Feature: "projects", Limit: limit(10)}, {Feature: "sso"}},
+			true,
+		},
+		{"disabled feature", map[string]string{MetadataFeaturePrefix + "sso": "false"}, nil, true},
+		{"cleared feature", map[string]string{MetadataFeaturePrefix + "sso": ""}, nil, true},
+		{"invalid limit", map[string]string{MetadataFeaturePrefix + "projects": "many"}, nil, true},
+		{"negative limit", map[string]string{MetadataFeaturePrefix + "projects": "-1"}, nil, true},
+		{"prefix without feature", map[string]string{MetadataFeaturePrefix: "true"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := productEntitlements(&stripe.Product{ID: "prod_1", Metadata: tt.metadata})
+			if found != tt.wantFound || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("productEntitlements() = %+v, %v, want %+v, %v", got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ type events struct {
 	subRemovedCallbacks      []func(*Subscription)
 	seatAddedCallbacks       []func(*Subscription, string)
 	seatRemovedCallbacks     []func(*Subscription, string)
+	seatRoleChangedCallbacks []func(*Subscription, *SubscriptionUser)
 	customerAddedCallbacks   []func(*Customer)
 	customerUpdatedCallbacks []func(*Customer, *Customer)
 	customerRemovedCallbacks []func(*Customer)
@@ -15,6 +16,15 @@ type events struct {
 	priceAddedCallbacks      []func(*Price)
 	priceUpdatedCallbacks    []func(*Price, *Price)
 	priceRemovedCallbacks    []func(*Price)
+	paymentAddedCallbacks    []func(*Payment)
+	inviteAddedCallbacks     []func(*SubscriptionInvite)
+	inviteResentCallbacks    []func(*SubscriptionInvite)
+	inviteAcceptedCallbacks  []func(*SubscriptionInvite)
+	inviteRevokedCallbacks   []func(*SubscriptionInvite)
+	inviteExpiredCallbacks   []func(*SubscriptionInvite)
+	cardExpiringCallbacks    []func(*CardExpiry)
+	paymentFailedCallbacks   []func(*PaymentFailure)
+	graceExpiringCallbacks   []func(*Subscription)
 }
 
 func (e *events) OnSeatAdded(cb func(*Subscription, string)) {
@@ -25,6 +35,10 @@ func (e *events) OnSeatRemoved(cb func(*Subscription, string)) {
 	e.seatRemovedCallbacks = append(e.seatRemovedCallbacks, cb)
 }
 
+func (e *events) OnSeatRoleChanged(cb func(*Subscription, *SubscriptionUser)) {
+	e.seatRoleChangedCallbacks = append(e.seatRoleChangedCallbacks, cb)
+}
+
 func (e *events) OnSubscriptionAdded(cb func(*Subscription)) {
 	e.subAddedCallbacks = append(e.subAddedCallbacks, cb)
 }
@@ -73,6 +87,42 @@ func (e *events) OnPriceRemoved(cb func(*Price)) {
 	e.priceRemovedCallbacks = append(e.priceRemovedCallbacks, cb)
 }
 
+func (e *events) OnPaymentAdded(cb func(*Payment)) {
+	e.paymentAddedCallbacks = append(e.paymentAddedCallbacks, cb)
+}
+
+func (e *events) OnCardExpiring(cb func(*CardExpiry)) {
+	e.cardExpiringCallbacks = append(e.cardExpiringCallbacks, cb)
+}
+
+func (e *events) OnPaymentFailed(cb func(*PaymentFailure)) {
+	e.paymentFailedCallbacks = append(e.paymentFailedCallbacks, cb)
+}
+
+func (e *events) OnGraceExpiring(cb func(*Subscription)) {
+	e.graceExpiringCallbacks = append(e.graceExpiringCallbacks, cb)
+}
+
+func (e *events) OnInviteAdded(cb func(*SubscriptionInvite)) {
+	e.inviteAddedCallbacks = append(e.inviteAddedCallbacks, cb)
+}
+
+func (e *events) OnInviteResent(cb func(*SubscriptionInvite)) {
+	e.inviteResentCallbacks = append(e.inviteResentCallbacks, cb)
+}
+
+func (e *events) OnInviteAccepted(cb func(*SubscriptionInvite)) {
+	e.inviteAcceptedCallbacks = append(e.inviteAcceptedCallbacks, cb)
+}
+
+func (e *events) OnInviteRevoked(cb func(*SubscriptionInvite)) {
+	e.inviteRevokedCallbacks = append(e.inviteRevokedCallbacks, cb)
+}
+
+func (e *events) OnInviteExpired(cb func(*SubscriptionInvite)) {
+	e.inviteExpiredCallbacks = append(e.inviteExpiredCallbacks, cb)
+}
+
 func (e *events) subAdded(s *Subscription) {
 	for _, cb := range e.subAddedCallbacks {
 		cb(s)
@@ -156,3 +206,63 @@ func (e *events) seatRemoved(s *Subscription, seat string) {
 		cb(s, seat)
 	}
 }
+
+func (e *events) seatRoleChanged(s *Subscription, su *SubscriptionUser) {
+	for _, cb := range e.seatRoleChangedCallbacks {
+		cb(s, su)
+	}
+}
+
+func (e *events) paymentAdded(p *Payment) {
+	for _, cb := range e.paymentAddedCallbacks {
+		cb(p)
+	}
+}
+
+func (e *events) inviteAdded(i *SubscriptionInvite) {
+	for _, cb := range e.inviteAddedCallbacks {
+		cb(i)
+	}
+}
+
+func (e *events) inviteResent(i *SubscriptionInvite) {
+	for _, cb := range e.inviteResentCallbacks {
+		cb(i)
+	}
+}
+
+func (e *events) inviteAccepted(i *SubscriptionInvite) {
+	for _, cb := range e.inviteAcceptedCallbacks {
+		cb(i)
+	}
+}
+
+func (e *events) inviteRevoked(i *SubscriptionInvite) {
+	for _, cb := range e.inviteRevokedCallbacks {
+		cb(i)
+	}
+}
+
+func (e *events) inviteExpired(i *SubscriptionInvite) {
+	for _, cb := range e.inviteExpiredCallbacks {
+		cb(i)
+	}
+}
+
+func (e *events) cardExpiring(c *CardExpiry) {
+	for _, cb := range e.cardExpiringCallbacks {
+		cb(c)
+	}
+}
+
+func (e *events) paymentFailed(f *PaymentFailure) {
+	for _, cb := range e.paymentFailedCallbacks {
+		cb(f)
+	}
+}
+
+func (e *events) graceExpiring(s *Subscription) {
+	for _, cb := range e.graceExpiringCallbacks {
+		cb(s)
+	}
+}
@@ -0,0 +1,117 @@
+package pay
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cristosal/orm"
+	"github.com/stripe/stripe-go/v74"
+)
+
+// SourceSync is the history source of changes found while syncing with the provider
+const SourceSync = "sync"
+
+// SourceGracePeriod is the history source of subscriptions deactivated when their grace period ended
+const SourceGracePeriod = "grace_period"
+
+// historySource is what caused a subscription change and when it happened
+type historySource struct {
+	Event string
+	At    time.Time
+}
+
+// syncSource is the source of changes made while syncing
+func syncSource() historySource {
+	return historySource{Event: SourceSync, At: time.Now()}
+}
+
+// eventSource is the source of changes made while handling a stripe webhook event
+func eventSource(e *stripe.Event) historySource {
+	return historySource{Event: e.ID, At: time.Unix(e.Created, 0)}
+}
+
+// subscriptionChange returns the transition from prev to next, or an empty string when nothing that is recorded has changed
+func subscriptionChange(prev, next *Subscription) SubscriptionChange {
+	switch {
+	case !prev.Active && next.Active:
+		return SubscriptionActivated
+	case prev.Active && !next.Active:
+		return SubscriptionDeactivated
+	case prev.Status != next.Status:
+		return SubscriptionStatusChanged
+	case prev.PriceID != next.PriceID:
+		return SubscriptionPriceChanged
+	case prev.CustomerID != next.CustomerID, prev.Quantity != next.Quantity, prev.CollectionPaused != next.CollectionPaused,
+		!sameID(prev.CouponID, next.CouponID):
+		return SubscriptionChanged
+	}
+
+	return ""
+}
+
+// addSubscriptionHistory appends the state of s after change to the subscription history
+func addSubscriptionHistory(db orm.QuerierExecuter, s *Subscription, change SubscriptionChange, src historySource) error {
+	return orm.Add(db, &SubscriptionHistory{
+		SubscriptionID: s.ID,
+		Provider:       s.Provider,
+		ProviderID:     s.ProviderID,
+		CustomerID:     s.CustomerID,
+		PriceID:        s.PriceID,
+		Active:         s.Active,
+		Status:         s.Status,
+		Quantity:       s.Quantity,
+		TrialEnd:       s.TrialEnd,
+		Change:         change,
+		Source:         src.Event,
+		ChangedAt:      src.At,
+		RecordedAt:     time.Now(),
+	})
+}
+
+// ListSubscriptionHistory returns the state changes of a subscription in the order they happened
+func (r *Repo) ListSubscriptionHistory(subID int64) ([]SubscriptionHistory, error) {
+	var history []SubscriptionHistory
+	if err := orm.List(r.db, &history, "WHERE subscription_id = $1 ORDER BY changed_at, id", subID); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// ListSubscriptionsActiveAt returns the last recorded state of every subscription that was active at the given time
+func (r *Repo) ListSubscriptionsActiveAt(t time.Time) ([]SubscriptionHistory, error) {
+	var h SubscriptionHistory
+	sql := fmt.Sprintf(`
+		SELECT %[1]s FROM (
+			SELECT DISTINCT ON (subscription_id) %[1]s
+			FROM %[2]s
+			WHERE changed_at <= $1
+			ORDER BY subscription_id, changed_at DESC, id DESC
+		) h
+		WHERE h.active AND h.change != '%[3]s'
+		ORDER BY h.subscription_id`,
+		orm.Columns(&h).List(),
+		orm.TableName(&h),
+		SubscriptionDeleted,
+	)
+
+	var history []SubscriptionHistory
+	if err := orm.Query(r.db, &history, sql, t); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// removeSubscriptionOrphans removes subscriptions that no longer exist at the provider, recording their deletion
+func (r *Repo) removeSubscriptionOrphans(provider string, ids []string) error {
+	src := syncSource()
+	return removeOrphans[Subscription](r.db, provider, ids, func(s *Subscription) {
+		if err := addSubscriptionHistory(r.db, s, SubscriptionDeleted, src); err != nil {
+			log.Printf("error recording deletion of subscription %s: %v", s.ProviderID, err)
+		}
+
+		r.subRemoved(s)
+	})
+}
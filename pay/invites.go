@@ -0,0 +1,354 @@
+package pay
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cristosal/orm"
+)
+
+// DefaultInviteTTL is how long an invite can be accepted when it is created or resent without an expiry
+const DefaultInviteTTL = 7 * 24 * time.Hour
+
+var (
+	ErrInviteEmailRequired = errors.New("invite email is required")
+	ErrInvitePending       = errors.New("email already has a pending invite")
+	ErrInviteNotPending    = errors.New("invite is not pending")
+	ErrInviteExpired       = errors.New("invite expired")
+	ErrInvalidInviteToken  = errors.New("invalid invite token")
+)
+
+// AcceptInviteRequest accepts the invite that the token was issued for.
+// The email of the invite is used when no username is given.
+type AcceptInviteRequest struct {
+	Token    string
+	Username string
+}
+
+// SetInviteSecret sets the secret that signs invite tokens.
+// A random secret is used when none is set, so pending invites can not be accepted after a restart.
+func (r *Repo) SetInviteSecret(secret string) {
+	r.inviteSecret = []byte(secret)
+}
+
+func (r *Repo) inviteKey() []byte {
+	r.inviteOnce.Do(func() {
+		if len(r.inviteSecret) > 0 {
+			return
+		}
+
+		r.inviteSecret = make([]byte, 32)
+		if _, err := rand.Read(r.inviteSecret); err != nil {
+			panic(fmt.Errorf("error generating invite secret: %w", err))
+		}
+	})
+
+	return r.inviteSecret
+}
+
+// inviteToken signs the id and expiry of the invite.
+// Resending an invite changes its expiry, which invalidates the tokens that were sent before.
+func (r *Repo) inviteToken(inv *SubscriptionInvite) string {
+	payload := fmt.Sprintf("%d.%d", inv.ID, inv.ExpiresAt.Unix())
+	return payload + "." + r.signInvite(payload)
+}
+
+func (r *Repo) signInvite(payload string) string {
+	mac := hmac.New(sha256.New, r.inviteKey())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyInviteToken checks the signature of a token and returns the id and expiry of the invite it was issued for
+func (r *Repo) verifyInviteToken(token string) (int64, int64, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(r.signInvite(token[:i]))) {
+		return 0, 0, ErrInvalidInviteToken
+	}
+
+	idPart, expPart, _ := strings.Cut(token[:i], ".")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return 0, 0, ErrInvalidInviteToken
+	}
+
+	exp, err := strconv.ParseInt(expPart, 10, 64)
+	if err != nil {
+		return 0, 0, ErrInvalidInviteToken
+	}
+
+	return id, exp, nil
+}
+
+// checkInvite fails when a token with the expiry exp can no longer accept the invite at now.
+// Tokens sent before the invite was resent carry an old expiry and are invalid.
+func checkInvite(inv *SubscriptionInvite, exp int64, now time.Time) error {
+	if inv.ExpiresAt.Unix() != exp {
+		return ErrInvalidInviteToken
+	}
+
+	if inv.Status == InviteExpired || (inv.Status == InvitePending && now.After(inv.ExpiresAt)) {
+		return ErrInviteExpired
+	}
+
+	if inv.Status != InvitePending {
+		return ErrInviteNotPending
+	}
+
+	return nil
+}
+
+// GetSubscriptionInviteByToken returns the pending invite that the token was issued for
+func (r *Repo) GetSubscriptionInviteByToken(token string) (*SubscriptionInvite, error) {
+	id, exp, err := r.verifyInviteToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	inv, err := r.GetSubscriptionInviteByID(id)
+	if errors.Is(err, orm.ErrNotFound) {
+		return nil, ErrInvalidInviteToken
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkInvite(inv, exp, time.Now()); err != nil {
+		return nil, err
+	}
+
+	inv.Token = token
+	return inv, nil
+}
+
+// GetSubscriptionInviteByID returns the invite with the given id
+func (r *Repo) GetSubscriptionInviteByID(id int64) (*SubscriptionInvite, error) {
+	var inv SubscriptionInvite
+	if err := orm.Get(r.db, &inv, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &inv, nil
+}
+
+// ListSubscriptionInvites returns the invites of a subscription, newest first
+func (r *Repo) ListSubscriptionInvites(subID int64) ([]SubscriptionInvite, error) {
+	var invites []SubscriptionInvite
+	if err := orm.List(r.db, &invites, "WHERE subscription_id = $1 ORDER BY created_at DESC, id DESC", subID); err != nil {
+		return nil, err
+	}
+
+	return invites, nil
+}
+
+// AddSubscriptionInvite creates a pending invite for an email and sets its token.
+// The invite expires after DefaultInviteTTL unless an expiry is given.
+func (r *Repo) AddSubscriptionInvite(inv *SubscriptionInvite) error {
+	inv.Email = strings.TrimSpace(inv.Email)
+	if inv.Email == "" {
+		return ErrInviteEmailRequired
+	}
+
+	now := time.Now()
+	if inv.ExpiresAt.IsZero() {
+		inv.ExpiresAt = now.Add(DefaultInviteTTL)
+	}
+
+	if !inv.ExpiresAt.After(now) {
+		return ErrInviteExpired
+	}
+
+	var s Subscription
+	if err := orm.Get(r.db, &s, "WHERE id = $1", inv.SubscriptionID); err != nil {
+		if errors.Is(err, orm.ErrNotFound) {
+			return ErrSubscriptionNotFound
+		}
+
+		return err
+	}
+
+	pending, err := orm.Count(r.db, inv, "WHERE subscription_id = $1 AND email = $2 AND status = $3", inv.SubscriptionID, inv.Email, InvitePending)
+	if err != nil {
+		return err
+	}
+
+	if pending > 0 {
+		return ErrInvitePending
+	}
+
+	// tokens carry the expiry in seconds
+	inv.ExpiresAt = inv.ExpiresAt.Truncate(time.Second)
+	inv.Status = InvitePending
+	inv.Username = ""
+	inv.CreatedAt = now
+	inv.AcceptedAt = nil
+
+	if err := orm.Add(r.db, inv); err != nil {
+		return err
+	}
+
+	inv.Token = r.inviteToken(inv)
+	r.inviteAdded(inv)
+	return nil
+}
+
+// ResendSubscriptionInvite issues a new token for a pending or expired invite and extends it by DefaultInviteTTL.
+// Tokens sent before no longer accept the invite.
+func (r *Repo) ResendSubscriptionInvite(id int64) (*SubscriptionInvite, error) {
+	inv, err := r.GetSubscriptionInviteByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if inv.Status != InvitePending && inv.Status != InviteExpired {
+		return nil, ErrInviteNotPending
+	}
+
+	expiresAt := time.Now().Add(DefaultInviteTTL).Truncate(time.Second)
+	sql := fmt.Sprintf("UPDATE %s SET status = $1, expires_at = $2 WHERE id = $3 AND status = $4", inv.TableName())
+	res, err := r.db.Exec(sql, InvitePending, expiresAt, inv.ID, inv.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		// accepted or revoked in the meantime
+		return nil, ErrInviteNotPending
+	}
+
+	inv.Status = InvitePending
+	inv.ExpiresAt = expiresAt
+	inv.Token = r.inviteToken(inv)
+	r.inviteResent(inv)
+	return inv, nil
+}
+
+// RevokeSubscriptionInvite stops a pending invite from being accepted
+func (r *Repo) RevokeSubscriptionInvite(id int64) (*SubscriptionInvite, error) {
+	inv, err := r.GetSubscriptionInviteByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := fmt.Sprintf("UPDATE %s SET status = $1 WHERE id = $2 AND status = $3", inv.TableName())
+	res, err := r.db.Exec(sql, InviteRevoked, inv.ID, InvitePending)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrInviteNotPending
+	}
+
+	inv.Status = InviteRevoked
+	r.inviteRevoked(inv)
+	return inv, nil
+}
+
+// AcceptSubscriptionInvite attaches a user to the subscription of the invite that the token was issued for.
+// The email of the invite is used as the username when none is given.
+func (r *Repo) AcceptSubscriptionInvite(token, username string) (*SubscriptionInvite, error) {
+	inv, err := r.GetSubscriptionInviteByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.acceptInvite(inv, username)
+}
+
+// AcceptSubscriptionInvite attaches a user to the subscription of the invite, billing for another seat with per seat billing
+func (s *StripeProvider) AcceptSubscriptionInvite(token, username string) (*SubscriptionInvite, error) {
+	inv, err := s.GetSubscriptionInviteByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	accepted, err := s.acceptInvite(inv, username)
+	if !errors.Is(err, ErrSeatLimitReached) {
+		return accepted, err
+	}
+
+	if err := s.billSeat(inv.SubscriptionID); err != nil {
+		return nil, err
+	}
+
+	return s.acceptInvite(inv, username)
+}
+
+// acceptInvite claims the invite and takes a seat in one transaction, so that an invite is used once
+// and is not used up when no seat is free. It fails with ErrInviteNotPending when the invite was accepted,
+// revoked or expired in the meantime.
+func (r *Repo) acceptInvite(inv *SubscriptionInvite, username string) (*SubscriptionInvite, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		username = inv.Email
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var accepted SubscriptionInvite
+	q := fmt.Sprintf("UPDATE %s SET status = $1, username = $2, accepted_at = $3 WHERE id = $4 AND status = $5 AND expires_at > $3 RETURNING %s",
+		accepted.TableName(),
+		orm.Columns(&accepted).List(),
+	)
+
+	if err := orm.QueryRow(tx, &accepted, q, InviteAccepted, username, time.Now(), inv.ID, InvitePending); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInviteNotPending
+		}
+
+		return nil, err
+	}
+
+	// the invite authorizes the seat
+	s, err := addSeat(tx, &SubscriptionUser{SubscriptionID: accepted.SubscriptionID, Username: username, System: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	r.seatAdded(s, username)
+	r.inviteAccepted(&accepted)
+	return &accepted, nil
+}
+
+// ExpireSubscriptionInvites marks the pending invites that have passed their expiry as expired and returns them
+func (r *Repo) ExpireSubscriptionInvites() ([]SubscriptionInvite, error) {
+	var inv SubscriptionInvite
+	sql := fmt.Sprintf("UPDATE %s SET status = $1 WHERE status = $2 AND expires_at <= NOW() RETURNING %s",
+		inv.TableName(),
+		orm.Columns(&inv).List(),
+	)
+
+	var expired []SubscriptionInvite
+	if err := orm.Query(r.db, &expired, sql, InviteExpired, InvitePending); err != nil {
+		return nil, err
+	}
+
+	for i := range expired {
+		r.inviteExpired(&expired[i])
+	}
+
+	return expired, nil
+}
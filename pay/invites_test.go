@@ -0,0 +1,82 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInviteToken(t *testing.T) {
+	r := &Repo{}
+	r.SetInviteSecret("secret")
+
+	exp := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	token := r.inviteToken(&SubscriptionInvite{ID: 42, ExpiresAt: exp})
+	sig := token[strings.LastIndexByte(token, '.')+1:]
+
+	other := &Repo{}
+	other.SetInviteSecret("other secret")
+
+	tests := []struct {
+		name    string
+		repo    *Repo
+		token   string
+		wantID  int64
+		wantErr error
+	}{
+		{"valid", r, token, 42, nil},
+		{"signed with another secret", other, token, 0, ErrInvalidInviteToken},
+		{"tampered signature", r, token[:len(token)-1] + "x", 0, ErrInvalidInviteToken},
+		{"tampered id", r, fmt.Sprintf("43.%d.%s", exp.Unix(), sig), 0, ErrInvalidInviteToken},
+		{"tampered expiry", r, fmt.Sprintf("42.%d.%s", exp.Add(time.Hour).Unix(), sig), 0, ErrInvalidInviteToken},
+		{"missing signature", r, "42", 0, ErrInvalidInviteToken},
+		{"empty", r, "", 0, ErrInvalidInviteToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, gotExp, err := tt.repo.verifyInviteToken(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("verifyInviteToken() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if id != tt.wantID || gotExp != exp.Unix() {
+				t.Errorf("verifyInviteToken() = %d, %d, want %d, %d", id, gotExp, tt.wantID, exp.Unix())
+			}
+		})
+	}
+}
+
+func TestCheckInvite(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	exp := now.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		inv     SubscriptionInvite
+		exp     int64
+		now     time.Time
+		wantErr error
+	}{
+		{"pending", SubscriptionInvite{Status: InvitePending, ExpiresAt: exp}, exp.Unix(), now, nil},
+		{"pending past its expiry", SubscriptionInvite{Status: InvitePending, ExpiresAt: exp}, exp.Unix(), exp.Add(time.Second), ErrInviteExpired},
+		{"marked expired", SubscriptionInvite{Status: InviteExpired, ExpiresAt: exp}, exp.Unix(), now, ErrInviteExpired},
+		{"resent since the token was sent", SubscriptionInvite{Status: InvitePending, ExpiresAt: exp.Add(time.Hour)}, exp.Unix(), now, ErrInvalidInviteToken},
+		{"accepted", SubscriptionInvite{Status: InviteAccepted, ExpiresAt: exp}, exp.Unix(), now, ErrInviteNotPending},
+		{"revoked", SubscriptionInvite{Status: InviteRevoked, ExpiresAt: exp}, exp.Unix(), now, ErrInviteNotPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkInvite(&tt.inv, tt.exp, tt.now); !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkInvite() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -91,4 +91,335 @@ var migrations = []orm.Migration{
 			)`,
 		Down: "DROP TABLE {{ .Schema }}.subscription_user",
 	},
+	{
+		Name:        "idempotent_request table",
+		Description: "creates a table for storing responses to idempotent requests",
+		Up: `CREATE TABLE {{ .Schema }}.idempotent_request (
+				id SERIAL PRIMARY KEY,
+				key VARCHAR(255) NOT NULL,
+				subject VARCHAR(255) NOT NULL,
+				response JSONB NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				UNIQUE (subject, key)
+			)`,
+		Down: "DROP TABLE {{ .Schema }}.idempotent_request",
+	},
+	{
+		Name:        "price active nickname metadata",
+		Description: "adds active, nickname and metadata columns to the price table",
+		Up: `ALTER TABLE {{ .Schema }}.price
+				ADD COLUMN active BOOL NOT NULL DEFAULT TRUE,
+				ADD COLUMN nickname VARCHAR(255) NOT NULL DEFAULT '',
+				ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}'`,
+		Down: `ALTER TABLE {{ .Schema }}.price
+				DROP COLUMN active,
+				DROP COLUMN nickname,
+				DROP COLUMN metadata`,
+	},
+	{
+		Name:        "subscription_history table",
+		Description: "creates an append only table of subscription state transitions, seeded with the current subscriptions",
+		Up: `CREATE TABLE {{ .Schema }}.subscription_history (
+				id SERIAL PRIMARY KEY,
+				subscription_id INT NOT NULL,
+				provider VARCHAR(255) NOT NULL,
+				provider_id VARCHAR(255) NOT NULL,
+				customer_id INT NOT NULL,
+				price_id INT NOT NULL,
+				active BOOL NOT NULL,
+				change VARCHAR(32) NOT NULL,
+				source VARCHAR(255) NOT NULL,
+				changed_at TIMESTAMPTZ NOT NULL,
+				recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+
+			CREATE INDEX subscription_history_subscription_id_idx ON {{ .Schema }}.subscription_history (subscription_id, changed_at);
+			CREATE INDEX subscription_history_changed_at_idx ON {{ .Schema }}.subscription_history (changed_at);
+
+			INSERT INTO {{ .Schema }}.subscription_history
+				(subscription_id, provider, provider_id, customer_id, price_id, active, change, source, changed_at)
+			SELECT id, provider, provider_id, customer_id, price_id, active, 'created', 'migration', created_at
+			FROM {{ .Schema }}.subscription`,
+		Down: "DROP TABLE {{ .Schema }}.subscription_history",
+	},
+	{
+		Name:        "subscription status periods quantity",
+		Description: "adds the status, billing period, trial, cancellation and quantity columns to subscriptions and their history",
+		Up: `ALTER TABLE {{ .Schema }}.subscription
+				ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT '',
+				ADD COLUMN current_period_start TIMESTAMPTZ,
+				ADD COLUMN current_period_end TIMESTAMPTZ,
+				ADD COLUMN trial_end TIMESTAMPTZ,
+				ADD COLUMN cancel_at TIMESTAMPTZ,
+				ADD COLUMN cancel_at_period_end BOOL NOT NULL DEFAULT FALSE,
+				ADD COLUMN canceled_at TIMESTAMPTZ,
+				ADD COLUMN quantity INT NOT NULL DEFAULT 1;
+
+			UPDATE {{ .Schema }}.subscription SET
+				status = CASE WHEN active THEN 'active' ELSE 'canceled' END,
+				current_period_start = created_at,
+				current_period_end = created_at;
+
+			ALTER TABLE {{ .Schema }}.subscription
+				ALTER COLUMN current_period_start SET NOT NULL,
+				ALTER COLUMN current_period_end SET NOT NULL;
+
+			ALTER TABLE {{ .Schema }}.subscription_history
+				ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT '',
+				ADD COLUMN quantity INT NOT NULL DEFAULT 1;
+
+			UPDATE {{ .Schema }}.subscription_history SET status = CASE WHEN active THEN 'active' ELSE 'canceled' END`,
+		Down: `ALTER TABLE {{ .Schema }}.subscription
+				DROP COLUMN status,
+				DROP COLUMN current_period_start,
+				DROP COLUMN current_period_end,
+				DROP COLUMN trial_end,
+				DROP COLUMN cancel_at,
+				DROP COLUMN cancel_at_period_end,
+				DROP COLUMN canceled_at,
+				DROP COLUMN quantity;
+
+			ALTER TABLE {{ .Schema }}.subscription_history
+				DROP COLUMN status,
+				DROP COLUMN quantity`,
+	},
+	{
+		Name:        "subscription_item table",
+		Description: "creates a table for the prices of a subscription, seeded with the price of every subscription",
+		Up: `CREATE TABLE {{ .Schema }}.subscription_item (
+				id SERIAL PRIMARY KEY,
+				subscription_id INT NOT NULL,
+				provider VARCHAR(255) NOT NULL,
+				provider_id VARCHAR(255) NOT NULL,
+				price_id INT NOT NULL,
+				quantity INT NOT NULL DEFAULT 1,
+				FOREIGN KEY (subscription_id) REFERENCES {{ .Schema }}.subscription (id) ON DELETE CASCADE,
+				FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id),
+				UNIQUE (subscription_id, provider_id)
+			);
+
+			INSERT INTO {{ .Schema }}.subscription_item (subscription_id, provider, provider_id, price_id, quantity)
+			SELECT id, provider, '', price_id, quantity FROM {{ .Schema }}.subscription`,
+		Down: "DROP TABLE {{ .Schema }}.subscription_item",
+	},
+	{
+		Name:        "subscription collection paused",
+		Description: "adds a column indicating whether payment collection is paused for a subscription",
+		Up:          "ALTER TABLE {{ .Schema }}.subscription ADD COLUMN collection_paused BOOL NOT NULL DEFAULT FALSE",
+		Down:        "ALTER TABLE {{ .Schema }}.subscription DROP COLUMN collection_paused",
+	},
+	{
+		Name:        "payment table",
+		Description: "creates a table for one-time payments",
+		Up: `CREATE TABLE {{ .Schema }}.payment (
+				id SERIAL PRIMARY KEY,
+				provider VARCHAR(255) NOT NULL,
+				provider_id VARCHAR(255) NOT NULL,
+				customer_id INT NOT NULL,
+				price_id INT,
+				amount BIGINT NOT NULL,
+				currency VARCHAR(16) NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL,
+				FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id),
+				FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id),
+				UNIQUE (provider, provider_id)
+			)`,
+		Down: "DROP TABLE {{ .Schema }}.payment",
+	},
+	{
+		Name:        "plan max seats",
+		Description: "adds the number of users that can be attached to each subscription of a plan",
+		Up:          "ALTER TABLE {{ .Schema }}.plan ADD COLUMN max_seats INT NOT NULL DEFAULT 0",
+		Down:        "ALTER TABLE {{ .Schema }}.plan DROP COLUMN max_seats",
+	},
+	{
+		Name:        "subscription_invite table",
+		Description: "creates a table for invitations to take a seat of a subscription",
+		Up: `CREATE TABLE {{ .Schema }}.subscription_invite (
+				id SERIAL PRIMARY KEY,
+				subscription_id INT NOT NULL,
+				email TEXT NOT NULL,
+				invited_by TEXT NOT NULL DEFAULT '',
+				status VARCHAR(16) NOT NULL,
+				username TEXT NOT NULL DEFAULT '',
+				expires_at TIMESTAMPTZ NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL,
+				accepted_at TIMESTAMPTZ,
+				FOREIGN KEY (subscription_id) REFERENCES {{ .Schema }}.subscription (id) ON DELETE CASCADE
+			);
+			CREATE UNIQUE INDEX subscription_invite_pending_idx ON {{ .Schema }}.subscription_invite (subscription_id, email) WHERE status = 'pending'`,
+		Down: "DROP TABLE {{ .Schema }}.subscription_invite",
+	},
+	{
+		Name:        "subscription_user role",
+		Description: "adds seat roles, making the customer or else the first user of every subscription its owner",
+		Up: `ALTER TABLE {{ .Schema }}.subscription_user ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'member';
+			UPDATE {{ .Schema }}.subscription_user su SET role = 'owner'
+			FROM {{ .Schema }}.subscription s
+			INNER JOIN {{ .Schema }}.customer c ON c.id = s.customer_id
+			WHERE su.subscription_id = s.id AND su.username = c.email;
+			UPDATE {{ .Schema }}.subscription_user su SET role = 'owner'
+			FROM (
+				SELECT subscription_id, MIN(username) AS username
+				FROM {{ .Schema }}.subscription_user
+				GROUP BY subscription_id
+				HAVING bool_and(role != 'owner')
+			) o
+			WHERE su.subscription_id = o.subscription_id AND su.username = o.username`,
+		Down: "ALTER TABLE {{ .Schema }}.subscription_user DROP COLUMN role",
+	},
+	{
+		Name:        "plan_entitlement table",
+		Description: "creates a table for the features and limits granted by plans",
+		Up: `CREATE TABLE {{ .Schema }}.plan_entitlement (
+				id SERIAL PRIMARY KEY,
+				plan_id INT NOT NULL,
+				feature VARCHAR(255) NOT NULL,
+				limit_value BIGINT,
+				FOREIGN KEY (plan_id) REFERENCES {{ .Schema }}.plan (id) ON DELETE CASCADE,
+				UNIQUE (plan_id, feature)
+			)`,
+		Down: "DROP TABLE {{ .Schema }}.plan_entitlement",
+	},
+	{
+		Name:        "usage_record table",
+		Description: "adds meters to prices and creates a table buffering the usage recorded for them",
+		Up: `ALTER TABLE {{ .Schema }}.price ADD COLUMN meter VARCHAR(255) NOT NULL DEFAULT '';
+			CREATE TABLE {{ .Schema }}.usage_record (
+				id SERIAL PRIMARY KEY,
+				subscription_id INT NOT NULL,
+				subscription_item_id INT NOT NULL,
+				username VARCHAR(255) NOT NULL DEFAULT '',
+				meter VARCHAR(255) NOT NULL,
+				quantity BIGINT NOT NULL,
+				timestamp TIMESTAMPTZ NOT NULL,
+				idempotency_key VARCHAR(255) NOT NULL DEFAULT '',
+				created_at TIMESTAMPTZ NOT NULL,
+				reported_at TIMESTAMPTZ,
+				error TEXT NOT NULL DEFAULT '',
+				FOREIGN KEY (subscription_id) REFERENCES {{ .Schema }}.subscription (id) ON DELETE CASCADE,
+				FOREIGN KEY (subscription_item_id) REFERENCES {{ .Schema }}.subscription_item (id) ON DELETE CASCADE
+			);
+			CREATE UNIQUE INDEX usage_record_idempotency_key_idx ON {{ .Schema }}.usage_record (idempotency_key) WHERE idempotency_key != '';
+			CREATE INDEX usage_record_unreported_idx ON {{ .Schema }}.usage_record (subscription_item_id) WHERE reported_at IS NULL`,
+		Down: `DROP TABLE {{ .Schema }}.usage_record;
+			ALTER TABLE {{ .Schema }}.price DROP COLUMN meter`,
+	},
+	{
+		Name:        "coupon and promotion_code tables",
+		Description: "creates tables for coupons and promotion codes and adds the discount of subscriptions",
+		Up: `CREATE TABLE {{ .Schema }}.coupon (
+				id SERIAL PRIMARY KEY,
+				provider VARCHAR(255) NOT NULL,
+				provider_id VARCHAR(255) NOT NULL,
+				name VARCHAR(255) NOT NULL DEFAULT '',
+				percent_off DOUBLE PRECISION NOT NULL DEFAULT 0,
+				amount_off BIGINT NOT NULL DEFAULT 0,
+				currency VARCHAR(3) NOT NULL DEFAULT '',
+				duration VARCHAR(16) NOT NULL,
+				duration_in_months INT NOT NULL DEFAULT 0,
+				max_redemptions BIGINT NOT NULL DEFAULT 0,
+				times_redeemed BIGINT NOT NULL DEFAULT 0,
+				redeem_by TIMESTAMPTZ,
+				valid BOOL NOT NULL DEFAULT TRUE,
+				created_at TIMESTAMPTZ NOT NULL,
+				UNIQUE (provider, provider_id)
+			);
+			CREATE TABLE {{ .Schema }}.promotion_code (
+				id SERIAL PRIMARY KEY,
+				coupon_id INT NOT NULL,
+				provider VARCHAR(255) NOT NULL,
+				provider_id VARCHAR(255) NOT NULL,
+				code VARCHAR(255) NOT NULL,
+				active BOOL NOT NULL DEFAULT TRUE,
+				customer_id INT,
+				max_redemptions BIGINT NOT NULL DEFAULT 0,
+				times_redeemed BIGINT NOT NULL DEFAULT 0,
+				expires_at TIMESTAMPTZ,
+				first_time_transaction BOOL NOT NULL DEFAULT FALSE,
+				created_at TIMESTAMPTZ NOT NULL,
+				FOREIGN KEY (coupon_id) REFERENCES {{ .Schema }}.coupon (id) ON DELETE CASCADE,
+				FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id) ON DELETE SET NULL,
+				UNIQUE (provider, provider_id)
+			);
+			ALTER TABLE {{ .Schema }}.subscription
+				ADD COLUMN coupon_id INT REFERENCES {{ .Schema }}.coupon (id) ON DELETE SET NULL,
+				ADD COLUMN promotion_code_id INT REFERENCES {{ .Schema }}.promotion_code (id) ON DELETE SET NULL,
+				ADD COLUMN discount_end TIMESTAMPTZ`,
+		Down: `ALTER TABLE {{ .Schema }}.subscription DROP COLUMN coupon_id, DROP COLUMN promotion_code_id, DROP COLUMN discount_end;
+			DROP TABLE {{ .Schema }}.promotion_code;
+			DROP TABLE {{ .Schema }}.coupon`,
+	},
+	{
+		Name:        "payment_method table",
+		Description: "creates a table for the payment methods saved for customers",
+		Up: `CREATE TABLE {{ .Schema }}.payment_method (
+				id SERIAL PRIMARY KEY,
+				customer_id INT NOT NULL,
+				provider VARCHAR(255) NOT NULL,
+				provider_id VARCHAR(255) NOT NULL,
+				type VARCHAR(64) NOT NULL,
+				brand VARCHAR(64) NOT NULL DEFAULT '',
+				last4 VARCHAR(4) NOT NULL DEFAULT '',
+				exp_month INT NOT NULL DEFAULT 0,
+				exp_year INT NOT NULL DEFAULT 0,
+				expires_at TIMESTAMPTZ,
+				is_default BOOL NOT NULL DEFAULT FALSE,
+				created_at TIMESTAMPTZ NOT NULL,
+				expiry_notified_at TIMESTAMPTZ,
+				FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id) ON DELETE CASCADE,
+				UNIQUE (provider, provider_id)
+			);
+			CREATE INDEX payment_method_expires_at_idx ON {{ .Schema }}.payment_method (expires_at) WHERE expiry_notified_at IS NULL`,
+		Down: "DROP TABLE {{ .Schema }}.payment_method",
+	},
+	{
+		Name:        "subscription grace period",
+		Description: "adds the dunning grace period of past due subscriptions",
+		Up: `ALTER TABLE {{ .Schema }}.subscription
+				ADD COLUMN payment_failed_at TIMESTAMPTZ,
+				ADD COLUMN grace_end TIMESTAMPTZ,
+				ADD COLUMN grace_reminded_at TIMESTAMPTZ;
+			CREATE INDEX subscription_grace_end_idx ON {{ .Schema }}.subscription (grace_end) WHERE active AND grace_end IS NOT NULL`,
+		Down: "ALTER TABLE {{ .Schema }}.subscription DROP COLUMN payment_failed_at, DROP COLUMN grace_end, DROP COLUMN grace_reminded_at",
+	},
+	{
+		Name:        "usage_record reporting batch",
+		Description: "claims usage records for a reporting batch so they are reported to stripe outside of a transaction",
+		Up: `ALTER TABLE {{ .Schema }}.usage_record
+				ADD COLUMN reporting_batch VARCHAR(64) NOT NULL DEFAULT '',
+				ADD COLUMN claimed_at TIMESTAMPTZ`,
+		Down: "ALTER TABLE {{ .Schema }}.usage_record DROP COLUMN reporting_batch, DROP COLUMN claimed_at",
+	},
+	{
+		Name:        "subscription_history trial_end",
+		Description: "records the trial end of subscriptions in their history, so trial conversion includes subscriptions that were removed",
+		Up: `ALTER TABLE {{ .Schema }}.subscription_history ADD COLUMN trial_end TIMESTAMPTZ;
+			UPDATE {{ .Schema }}.subscription_history h SET trial_end = s.trial_end
+			FROM {{ .Schema }}.subscription s WHERE s.id = h.subscription_id`,
+		Down: "ALTER TABLE {{ .Schema }}.subscription_history DROP COLUMN trial_end",
+	},
+	{
+		Name:        "payment set null",
+		Description: "keeps payments when their customer or price is removed",
+		Up: `ALTER TABLE {{ .Schema }}.payment
+				ALTER COLUMN customer_id DROP NOT NULL,
+				DROP CONSTRAINT payment_customer_id_fkey,
+				DROP CONSTRAINT payment_price_id_fkey,
+				ADD FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id) ON DELETE SET NULL,
+				ADD FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id) ON DELETE SET NULL`,
+		Down: `DELETE FROM {{ .Schema }}.payment WHERE customer_id IS NULL;
+			ALTER TABLE {{ .Schema }}.payment
+				ALTER COLUMN customer_id SET NOT NULL,
+				DROP CONSTRAINT payment_customer_id_fkey,
+				DROP CONSTRAINT payment_price_id_fkey,
+				ADD FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id),
+				ADD FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id)`,
+	},
+	{
+		Name:        "usage_record report attempts",
+		Description: "counts how often usage records were claimed for reporting so that failing batches are given up",
+		Up:          "ALTER TABLE {{ .Schema }}.usage_record ADD COLUMN report_attempts INT NOT NULL DEFAULT 0",
+		Down:        "ALTER TABLE {{ .Schema }}.usage_record DROP COLUMN report_attempts",
+	},
 }
@@ -5,6 +5,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/cristosal/orm"
 	"github.com/cristosal/orm/schema"
@@ -14,8 +17,9 @@ import (
 const DefaultSchema = "pay"
 
 var (
-	ErrSubscriptionNotFound  = errors.New("subscription not found")
-	ErrSubscriptionNotActive = errors.New("subscription not active")
+	ErrSubscriptionNotFound     = errors.New("subscription not found")
+	ErrSubscriptionNotActive    = errors.New("subscription not active")
+	ErrSubscriptionItemNotFound = errors.New("subscription item not found")
 )
 
 type Migration = orm.Migration
@@ -27,6 +31,8 @@ type Repo struct {
 	migrationTable  string
 	schema          string
 	extraMigrations []orm.Migration
+	inviteSecret    []byte
+	inviteOnce      sync.Once
 }
 
 // NewEntityRepo is a constructor for *Repo
@@ -120,6 +126,17 @@ func (r *Repo) ListAllWebhookEvents() ([]WebhookEvent, error) {
 	return webhookEvents, nil
 }
 
+// ListWebhookEventsByProviderID returns the webhook events for the object with the given provider id
+// or the events of objects belonging to the customer with that id, newest first
+func (r *Repo) ListWebhookEventsByProviderID(providerID string) ([]WebhookEvent, error) {
+	var webhookEvents []WebhookEvent
+	if err := orm.List(r.db, &webhookEvents, "WHERE payload->>'id' = $1 OR payload->>'customer' = $1 ORDER BY id DESC", providerID); err != nil {
+		return nil, err
+	}
+
+	return webhookEvents, nil
+}
+
 // ListAllPrices returns a list of prices
 func (r *Repo) ListAllPrices() ([]Price, error) {
 	var prices []Price
@@ -145,6 +162,11 @@ func (r *Repo) ListAllSubscriptions() ([]Subscription, error) {
 	if err := orm.ListAll(r.db, &subs); err != nil {
 		return nil, err
 	}
+
+	if err := r.loadSubscriptionItems(subs); err != nil {
+		return nil, err
+	}
+
 	return subs, nil
 }
 
@@ -172,6 +194,25 @@ func (r *Repo) updatePriceByProvider(p *Price) error {
 	return nil
 }
 
+// upsertPrice adds the price or updates it when it is already stored. The id of the stored price is set on p
+func (r *Repo) upsertPrice(p *Price) error {
+	prev, err := r.GetPriceByProvider(p.Provider, p.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addPrice(p)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p.ID = prev.ID
+	if reflect.DeepEqual(prev, p) {
+		return nil
+	}
+
+	return r.updatePriceByProvider(p)
+}
+
 // RemovePrice deletes price from repository
 func (r *Repo) removePriceByProvider(p *Price) error {
 	err := orm.Remove(r.db, "WHERE provider = $1 AND provider_id = $2", p.Provider, p.ProviderID)
@@ -227,6 +268,25 @@ func (r *Repo) updateCustomerByProvider(c *Customer) error {
 	return nil
 }
 
+// upsertCustomer adds the customer or updates it when it is already stored. The id of the stored customer is set on c
+func (r *Repo) upsertCustomer(c *Customer) error {
+	prev, err := r.GetCustomerByProvider(c.Provider, c.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addCustomer(c)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.ID = prev.ID
+	if *prev == *c {
+		return nil
+	}
+
+	return r.updateCustomerByProvider(c)
+}
+
 // AddCustomer inserts a customer into the repository
 func (r *Repo) addCustomer(c *Customer) error {
 	if err := orm.Add(r.db, c); err != nil {
@@ -259,10 +319,6 @@ func (r *Repo) removePriceOrphans(provider string, ids []string) error {
 	return removeOrphans[Price](r.db, provider, ids, r.priceRemoved)
 }
 
-func (r *Repo) removeSubscriptionOrphans(provider string, ids []string) error {
-	return removeOrphans[Subscription](r.db, provider, ids, r.subRemoved)
-}
-
 func (r *Repo) removeCustomerOrphans(provider string, ids []string) error {
 	return removeOrphans[Customer](r.db, provider, ids, r.customerRemoved)
 }
@@ -361,6 +417,25 @@ func (r *Repo) updatePlanByProvider(p *Plan) error {
 	return nil
 }
 
+// upsertPlan adds the plan or updates it when it is already stored. The id of the stored plan is set on p
+func (r *Repo) upsertPlan(p *Plan) error {
+	prev, err := r.GetPlanByProviderID(p.Provider, p.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addPlan(p)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p.ID = prev.ID
+	if *prev == *p {
+		return nil
+	}
+
+	return r.updatePlanByProvider(p)
+}
+
 // GetPlanByID returns the plan matching the internal id
 func (r *Repo) GetPlanByID(id int64) (*Plan, error) {
 	var p Plan
@@ -390,7 +465,7 @@ func (r *Repo) GetPlanByName(name string) (*Plan, error) {
 	return &p, nil
 }
 
-func (r *Repo) addSubscription(s *Subscription) error {
+func (r *Repo) addSubscription(s *Subscription, src historySource) error {
 	// get customer as we will be adding a user with same email
 	cust, err := r.GetCustomerByID(s.CustomerID)
 	if err != nil {
@@ -411,10 +486,19 @@ func (r *Repo) addSubscription(s *Subscription) error {
 	if err := orm.Add(tx, &SubscriptionUser{
 		SubscriptionID: s.ID,
 		Username:       cust.Email,
+		Role:           SeatOwner,
 	}); err != nil {
 		return err
 	}
 
+	if err := saveSubscriptionItems(tx, s); err != nil {
+		return err
+	}
+
+	if err := addSubscriptionHistory(tx, s, SubscriptionCreated, src); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return err
 	}
@@ -423,14 +507,35 @@ func (r *Repo) addSubscription(s *Subscription) error {
 	return nil
 }
 
-func (r *Repo) updateSubscriptionByProvider(s *Subscription) error {
+func (r *Repo) updateSubscriptionByProvider(s *Subscription, src historySource) error {
 	var prev Subscription
 	if err := orm.Get(r.db, &prev, "WHERE provider = $1 AND provider_id = $2", s.Provider, s.ProviderID); err != nil {
 		return err
 	}
 
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
 	s.ID = prev.ID // the id can't change
-	if err := orm.UpdateByID(r.db, s); err != nil {
+	if err := orm.UpdateByID(tx, s); err != nil {
+		return err
+	}
+
+	if err := saveSubscriptionItems(tx, s); err != nil {
+		return err
+	}
+
+	if change := subscriptionChange(&prev, s); change != "" {
+		if err := addSubscriptionHistory(tx, s, change, src); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
@@ -438,12 +543,27 @@ func (r *Repo) updateSubscriptionByProvider(s *Subscription) error {
 	return nil
 }
 
-func (r *Repo) removeSubscriptionByProvider(s *Subscription) error {
+func (r *Repo) removeSubscriptionByProvider(s *Subscription, src historySource) error {
 	table := s.TableName()
 	cols := orm.Columns(s).List()
 	sql := fmt.Sprintf("DELETE FROM %s WHERE provider = $1 AND provider_id = $2 RETURNING %s", table, cols)
 
-	if err := orm.QueryRow(r.db, s, sql, s.Provider, s.ProviderID); err != nil {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := orm.QueryRow(tx, s, sql, s.Provider, s.ProviderID); err != nil {
+		return err
+	}
+
+	if err := addSubscriptionHistory(tx, s, SubscriptionDeleted, src); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
@@ -457,28 +577,39 @@ func (r *Repo) ListSubscriptionsByCustomerID(customerID int64) ([]Subscription,
 		return nil, err
 	}
 
+	if err := r.loadSubscriptionItems(s); err != nil {
+		return nil, err
+	}
+
 	return s, nil
 }
 
 func (r *Repo) ListSubscriptionsByPlanID(planID int64) ([]Subscription, error) {
 	var (
 		subs []Subscription
+		si   SubscriptionItem
 		pr   Price
-		pl   Plan
 		s    Subscription
 	)
 
-	sql := fmt.Sprintf(`SELECT %s FROM %s s INNER JOIN %s pr ON s.price_id = pr.id INNER JOIN %s pl ON pr.plan_id = pl.id AND pl.id = $1`,
+	sql := fmt.Sprintf(`SELECT %s FROM %s s WHERE EXISTS (
+			SELECT 1 FROM %s si INNER JOIN %s pr ON si.price_id = pr.id
+			WHERE si.subscription_id = s.id AND pr.plan_id = $1
+		)`,
 		orm.Columns(&s).PrefixedList("s"),
 		orm.TableName(&s),
+		orm.TableName(&si),
 		orm.TableName(&pr),
-		orm.TableName(&pl),
 	)
 
 	if err := orm.Query(r.db, &subs, sql, planID); err != nil {
 		return nil, err
 	}
 
+	if err := r.loadSubscriptionItems(subs); err != nil {
+		return nil, err
+	}
+
 	return subs, nil
 }
 
@@ -489,6 +620,12 @@ func (r *Repo) GetSubscriptionByID(id int64) (*Subscription, error) {
 		return nil, err
 	}
 
+	items, err := r.ListSubscriptionItems(s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Items = items
 	return &s, nil
 }
 
@@ -498,9 +635,124 @@ func (r *Repo) GetSubscriptionByProvider(provider, providerID string) (*Subscrip
 		return nil, err
 	}
 
+	items, err := r.ListSubscriptionItems(s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Items = items
 	return &s, nil
 }
 
+// ListSubscriptionItems returns the prices a subscription is billed for
+func (r *Repo) ListSubscriptionItems(subID int64) ([]SubscriptionItem, error) {
+	var items []SubscriptionItem
+	if err := orm.List(r.db, &items, "WHERE subscription_id = $1 ORDER BY id", subID); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// loadSubscriptionItems sets the items of every subscription in subs
+func (r *Repo) loadSubscriptionItems(subs []Subscription) error {
+	if len(subs) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(subs))
+	for i := range subs {
+		ids[i] = subs[i].ID
+	}
+
+	var items []SubscriptionItem
+	if err := orm.List(r.db, &items, "WHERE subscription_id = ANY($1) ORDER BY id", ids); err != nil {
+		return err
+	}
+
+	bySub := make(map[int64][]SubscriptionItem)
+	for _, item := range items {
+		bySub[item.SubscriptionID] = append(bySub[item.SubscriptionID], item)
+	}
+
+	for i := range subs {
+		subs[i].Items = bySub[subs[i].ID]
+	}
+
+	return nil
+}
+
+// saveSubscriptionItems stores the items of s, removing the ones that are no longer part of the subscription
+func saveSubscriptionItems(db orm.QuerierExecuter, s *Subscription) error {
+	var prev []SubscriptionItem
+	if err := orm.List(db, &prev, "WHERE subscription_id = $1", s.ID); err != nil {
+		return err
+	}
+
+	existing := make(map[string]int64)
+	for _, item := range prev {
+		existing[item.ProviderID] = item.ID
+	}
+
+	for i := range s.Items {
+		item := &s.Items[i]
+		item.SubscriptionID = s.ID
+
+		id, exists := existing[item.ProviderID]
+		if !exists {
+			if err := orm.Add(db, item); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		delete(existing, item.ProviderID)
+		item.ID = id
+		if err := orm.UpdateByID(db, item); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range existing {
+		if err := orm.RemoveByID(db, &SubscriptionItem{ID: id}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addPayment stores a payment and fires the payment added callbacks
+func (r *Repo) addPayment(p *Payment) error {
+	if err := orm.Add(r.db, p); err != nil {
+		return err
+	}
+
+	r.paymentAdded(p)
+	return nil
+}
+
+// GetPaymentByProvider returns the payment with the given provider id
+func (r *Repo) GetPaymentByProvider(provider, providerID string) (*Payment, error) {
+	var p Payment
+	if err := orm.Get(r.db, &p, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// ListPaymentsByCustomerID returns the one-time payments of a customer, newest first
+func (r *Repo) ListPaymentsByCustomerID(customerID int64) ([]Payment, error) {
+	var payments []Payment
+	if err := orm.List(r.db, &payments, "WHERE customer_id = $1 ORDER BY created_at DESC", customerID); err != nil {
+		return nil, err
+	}
+
+	return payments, nil
+}
+
 func (r *Repo) hasWebhookEvent(provider, providerID string) bool {
 	var e WebhookEvent
 	if err := orm.Get(r.db, &e, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
@@ -553,26 +805,24 @@ func (r *Repo) GetPlanBySubscriptionID(subID int64) (*Plan, error) {
 
 func (r *Repo) GetPlansByUsername(username string) (plans []Plan, err error) {
 	var (
-		s  Subscription
+		si SubscriptionItem
 		su SubscriptionUser
 		pr Price
 		pl Plan
 	)
 
 	sql := fmt.Sprintf(`
-		SELECT %s FROM %s pl 
+		SELECT DISTINCT %s FROM %s pl
 		INNER JOIN %s pr ON pr.plan_id = pl.id
-		INNER JOIN %s s ON s.price_id = pr.id
-		INNER JOIN %s su ON su.subscription_id = s.id AND su.username = $1`,
+		INNER JOIN %s si ON si.price_id = pr.id
+		INNER JOIN %s su ON su.subscription_id = si.subscription_id AND su.username = $1`,
 		orm.Columns(&pl).PrefixedList("pl"),
 		orm.TableName(&pl),
 		orm.TableName(&pr),
-		orm.TableName(&s),
+		orm.TableName(&si),
 		orm.TableName(&su),
 	)
 
-	fmt.Println(sql)
-
 	if err := orm.Query(r.db, &plans, sql, username); err != nil {
 		return nil, err
 	}
@@ -601,6 +851,10 @@ func (r *Repo) ListSubscriptionsByUsername(username string) ([]Subscription, err
 		return nil, err
 	}
 
+	if err := r.loadSubscriptionItems(subs); err != nil {
+		return nil, err
+	}
+
 	return subs, nil
 }
 
@@ -608,49 +862,32 @@ func (r *Repo) CountSubscriptionUsers(subID int64) (int64, error) {
 	return orm.Count(r.db, &SubscriptionUser{}, "WHERE subscription_id = $1", subID)
 }
 
-func (r *Repo) AddSubscriptionUser(su *SubscriptionUser) error {
-	var s Subscription
-
-	s.ID = su.SubscriptionID
-
-	if err := orm.GetByID(r.db, &s); err != nil {
-		if errors.Is(err, orm.ErrNotFound) {
-			return ErrSubscriptionNotFound
-		}
-
-		return err
-	}
-
-	if err := orm.Add(r.db, su); err != nil {
-		return err
+// ListUsername returns a list of all usernames attached to subscription
+func (r *Repo) ListUsernames(subID int64) ([]string, error) {
+	sql := fmt.Sprintf("SELECT username from %s WHERE subscription_id = $1", orm.TableName(&SubscriptionUser{}))
+	rows, err := r.db.Query(sql, subID)
+	if err != nil {
+		return nil, err
 	}
 
-	r.seatAdded(&s, su.Username)
-	return nil
+	return orm.CollectStrings(rows)
 }
 
-func (r *Repo) RemoveSubscriptionUser(su *SubscriptionUser) error {
-	var s Subscription
-	s.ID = su.SubscriptionID
-	if err := orm.GetByID(r.db, &s); err != nil {
-		return err
-	}
-
-	if err := orm.Remove(r.db, su, "WHERE subscription_id = $1 and username = $2", su.SubscriptionID, su.Username); err != nil {
-		return err
+// GetIdempotentRequest returns the stored request for subject with the given idempotency key
+func (r *Repo) GetIdempotentRequest(subject, key string) (*IdempotentRequest, error) {
+	var req IdempotentRequest
+	if err := orm.Get(r.db, &req, "WHERE subject = $1 AND key = $2", subject, key); err != nil {
+		return nil, err
 	}
 
-	r.seatRemoved(&s, su.Username)
-	return nil
+	return &req, nil
 }
 
-// ListUsername returns a list of all usernames attached to subscription
-func (r *Repo) ListUsernames(subID int64) ([]string, error) {
-	sql := fmt.Sprintf("SELECT username from %s WHERE subscription_id = $1", orm.TableName(&SubscriptionUser{}))
-	rows, err := r.db.Query(sql, subID)
-	if err != nil {
-		return nil, err
+// AddIdempotentRequest stores the response to a request so that it can be returned on repeat calls
+func (r *Repo) AddIdempotentRequest(req *IdempotentRequest) error {
+	if req.CreatedAt.IsZero() {
+		req.CreatedAt = time.Now()
 	}
 
-	return orm.CollectStrings(rows)
+	return orm.Add(r.db, req)
 }
@@ -0,0 +1,254 @@
+package pay
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/cristosal/orm"
+)
+
+var (
+	ErrInvalidSeatRole = errors.New("invalid seat role")
+	ErrSeatForbidden   = errors.New("only owners and admins can manage seats")
+	ErrLastOwner       = errors.New("subscription needs at least one owner")
+	ErrNotSeatUser     = errors.New("user is not attached to the subscription")
+	ErrActorRequired   = errors.New("actor is required")
+)
+
+// TransferOwnershipRequest hands the ownership of a subscription from one of its owners to another of its users.
+// The previous owner stays on as an admin.
+type TransferOwnershipRequest struct {
+	SubscriptionID int64
+	From           string
+	To             string
+}
+
+func validSeatRole(role SeatRole) bool {
+	switch role {
+	case SeatOwner, SeatAdmin, SeatMember:
+		return true
+	}
+
+	return false
+}
+
+// getSeatRole returns the role of a user in a subscription, failing with ErrNotSeatUser when the user has no seat
+func getSeatRole(db orm.QuerierExecuter, subID int64, username string) (SeatRole, error) {
+	var role SeatRole
+	q := fmt.Sprintf("SELECT role FROM %s WHERE subscription_id = $1 AND username = $2", orm.TableName(&SubscriptionUser{}))
+	if err := db.QueryRow(q, subID, username).Scan(&role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotSeatUser
+		}
+
+		return "", err
+	}
+
+	return role, nil
+}
+
+// authorizeSeatChange checks that the actor of su can change a seat with the given role.
+// Owners manage every seat while admins manage admin and member seats. Only changes made by the system skip the check.
+func authorizeSeatChange(db orm.QuerierExecuter, subID int64, su *SubscriptionUser, role SeatRole) error {
+	if su.System {
+		return nil
+	}
+
+	if su.Actor == "" {
+		return ErrActorRequired
+	}
+
+	actorRole, err := getSeatRole(db, subID, su.Actor)
+	if errors.Is(err, ErrNotSeatUser) {
+		return ErrSeatForbidden
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if actorRole == SeatOwner || (actorRole == SeatAdmin && role != SeatOwner) {
+		return nil
+	}
+
+	return ErrSeatForbidden
+}
+
+// checkOwnerRemains fails with ErrLastOwner when the user is the only owner of the subscription
+func checkOwnerRemains(db orm.QuerierExecuter, subID int64, username string) error {
+	owners, err := orm.Count(db, &SubscriptionUser{}, "WHERE subscription_id = $1 AND role = $2 AND username != $3", subID, SeatOwner, username)
+	if err != nil {
+		return err
+	}
+
+	if owners == 0 {
+		return ErrLastOwner
+	}
+
+	return nil
+}
+
+// ListSubscriptionUsers returns the users attached to a subscription along with their roles
+func (r *Repo) ListSubscriptionUsers(subID int64) ([]SubscriptionUser, error) {
+	var users []SubscriptionUser
+	if err := orm.List(r.db, &users, "WHERE subscription_id = $1 ORDER BY username", subID); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// RemoveSubscriptionUser detaches a user from a subscription.
+// Users can always remove themselves, except for the last owner who has to transfer the ownership first.
+func (r *Repo) RemoveSubscriptionUser(su *SubscriptionUser) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	s, err := lockSubscription(tx, su.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	role, err := getSeatRole(tx, s.ID, su.Username)
+	if err != nil {
+		return err
+	}
+
+	if su.Actor != su.Username {
+		if err := authorizeSeatChange(tx, s.ID, su, role); err != nil {
+			return err
+		}
+	}
+
+	if role == SeatOwner {
+		if err := checkOwnerRemains(tx, s.ID, su.Username); err != nil {
+			return err
+		}
+	}
+
+	if err := orm.Remove(tx, su, "WHERE subscription_id = $1 and username = $2", su.SubscriptionID, su.Username); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.seatRemoved(s, su.Username)
+	return nil
+}
+
+// SetSubscriptionUserRole changes the role of a user attached to a subscription.
+// Only owners can make other users owners or change the role of an owner, and the last owner can not be demoted.
+func (r *Repo) SetSubscriptionUserRole(su *SubscriptionUser) error {
+	if !validSeatRole(su.Role) {
+		return ErrInvalidSeatRole
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	s, err := lockSubscription(tx, su.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	prev, err := getSeatRole(tx, s.ID, su.Username)
+	if err != nil {
+		return err
+	}
+
+	if prev == su.Role {
+		return nil
+	}
+
+	// demoting an owner or promoting to owner both require an owner
+	required := su.Role
+	if prev == SeatOwner {
+		required = SeatOwner
+	}
+
+	if err := authorizeSeatChange(tx, s.ID, su, required); err != nil {
+		return err
+	}
+
+	if prev == SeatOwner {
+		if err := checkOwnerRemains(tx, s.ID, su.Username); err != nil {
+			return err
+		}
+	}
+
+	if err := setSeatRole(tx, s.ID, su.Username, su.Role); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.seatRoleChanged(s, su)
+	return nil
+}
+
+// TransferSubscriptionOwnership makes To an owner of the subscription and From, who has to be an owner, an admin
+func (r *Repo) TransferSubscriptionOwnership(req *TransferOwnershipRequest) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	s, err := lockSubscription(tx, req.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	from, err := getSeatRole(tx, s.ID, req.From)
+	if err != nil {
+		return err
+	}
+
+	if from != SeatOwner {
+		return ErrSeatForbidden
+	}
+
+	if req.To == req.From {
+		return nil
+	}
+
+	if _, err := getSeatRole(tx, s.ID, req.To); err != nil {
+		return err
+	}
+
+	if err := setSeatRole(tx, s.ID, req.To, SeatOwner); err != nil {
+		return err
+	}
+
+	if err := setSeatRole(tx, s.ID, req.From, SeatAdmin); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.seatRoleChanged(s, &SubscriptionUser{SubscriptionID: s.ID, Username: req.To, Role: SeatOwner, Actor: req.From})
+	r.seatRoleChanged(s, &SubscriptionUser{SubscriptionID: s.ID, Username: req.From, Role: SeatAdmin, Actor: req.From})
+	return nil
+}
+
+func setSeatRole(db orm.QuerierExecuter, subID int64, username string, role SeatRole) error {
+	q := fmt.Sprintf("UPDATE %s SET role = $1 WHERE subscription_id = $2 AND username = $3", orm.TableName(&SubscriptionUser{}))
+	_, err := db.Exec(q, role, subID, username)
+	return err
+}
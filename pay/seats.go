@@ -0,0 +1,249 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cristosal/orm"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/subscription"
+)
+
+// MetadataMaxSeats is the product metadata key holding the max seats of a plan
+const MetadataMaxSeats = "cent_max_seats"
+
+// SourceSeatBilling is the history source of quantity changes made when seats are added with per seat billing
+const SourceSeatBilling = "seat_billing"
+
+var (
+	ErrSeatLimitReached = errors.New("seat limit reached")
+	ErrInvalidMaxSeats  = errors.New("max seats must be zero or more")
+)
+
+// Seats are the users that can be attached to a subscription and how many of them are taken
+type Seats struct {
+	SubscriptionID int64
+	Limit          int64
+	Used           int64
+	Fixed          bool // the limit is the max seats of the plan instead of the subscription quantity
+}
+
+// Free returns the number of users that can still be attached to the subscription
+func (s *Seats) Free() int64 {
+	if s.Used >= s.Limit {
+		return 0
+	}
+
+	return s.Limit - s.Used
+}
+
+// GetSeats returns the seat limit of a subscription and the number of users attached to it.
+// Plans with max seats limit every subscription to them, otherwise the limit is the quantity that was bought.
+func (r *Repo) GetSeats(subID int64) (*Seats, error) {
+	var s Subscription
+	if err := orm.Get(r.db, &s, "WHERE id = $1", subID); err != nil {
+		if errors.Is(err, orm.ErrNotFound) {
+			return nil, ErrSubscriptionNotFound
+		}
+
+		return nil, err
+	}
+
+	return getSeats(r.db, &s)
+}
+
+// AddSubscriptionUser attaches a user to a subscription, failing with ErrSeatLimitReached when every seat is taken.
+// Users are attached as members unless another role is given.
+func (r *Repo) AddSubscriptionUser(su *SubscriptionUser) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	s, err := addSeat(tx, su)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.seatAdded(s, su.Username)
+	return nil
+}
+
+// addSeat attaches a user to a free seat of its subscription within tx and returns the subscription
+func addSeat(tx orm.QuerierExecuter, su *SubscriptionUser) (*Subscription, error) {
+	if su.Role == "" {
+		su.Role = SeatMember
+	}
+
+	if !validSeatRole(su.Role) {
+		return nil, ErrInvalidSeatRole
+	}
+
+	// the lock keeps concurrent additions from taking the same free seat
+	s, err := lockSubscription(tx, su.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := authorizeSeatChange(tx, s.ID, su, su.Role); err != nil {
+		return nil, err
+	}
+
+	seats, err := getSeats(tx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if seats.Free() == 0 {
+		return nil, ErrSeatLimitReached
+	}
+
+	if err := orm.Add(tx, su); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// lockSubscription gets the subscription with the given id, locking it until the transaction ends
+func lockSubscription(tx orm.QuerierExecuter, id int64) (*Subscription, error) {
+	var s Subscription
+	if err := orm.Get(tx, &s, "WHERE id = $1 FOR UPDATE", id); err != nil {
+		if errors.Is(err, orm.ErrNotFound) {
+			return nil, ErrSubscriptionNotFound
+		}
+
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// getSeats returns the seats of s
+func getSeats(db orm.QuerierExecuter, s *Subscription) (*Seats, error) {
+	var maxSeats int64
+	sql := fmt.Sprintf("SELECT pl.max_seats FROM %s pl INNER JOIN %s pr ON pr.plan_id = pl.id WHERE pr.id = $1",
+		orm.TableName(&Plan{}),
+		orm.TableName(&Price{}),
+	)
+
+	if err := db.QueryRow(sql, s.PriceID).Scan(&maxSeats); err != nil {
+		return nil, err
+	}
+
+	used, err := orm.Count(db, &SubscriptionUser{}, "WHERE subscription_id = $1", s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	seats := Seats{
+		SubscriptionID: s.ID,
+		Limit:          s.Quantity,
+		Used:           used,
+	}
+
+	if maxSeats > 0 {
+		seats.Limit = maxSeats
+		seats.Fixed = true
+	}
+
+	// metered prices have no quantity, which still leaves a seat for the customer
+	if seats.Limit < 1 {
+		seats.Limit = 1
+	}
+
+	return &seats, nil
+}
+
+// AddSubscriptionUser attaches a user to a subscription.
+// With per seat billing, subscriptions whose seats are bought as quantity are billed for another seat when every seat is taken.
+func (s *StripeProvider) AddSubscriptionUser(su *SubscriptionUser) error {
+	err := s.Repo.AddSubscriptionUser(su)
+	if !errors.Is(err, ErrSeatLimitReached) {
+		return err
+	}
+
+	if err := s.billSeat(su.SubscriptionID); err != nil {
+		return err
+	}
+
+	return s.Repo.AddSubscriptionUser(su)
+}
+
+// billSeat raises the quantity of a full subscription by one seat with per seat billing.
+// It fails with ErrSeatLimitReached when seats are not billed or limited by the plan.
+func (s *StripeProvider) billSeat(subID int64) error {
+	if !s.config.PerSeatBilling {
+		return ErrSeatLimitReached
+	}
+
+	seats, err := s.GetSeats(subID)
+	if err != nil {
+		return err
+	}
+
+	if seats.Fixed {
+		return ErrSeatLimitReached
+	}
+
+	if err := s.setSeatQuantity(subID, seats.Used+1); err != nil {
+		return fmt.Errorf("error adding seat: %w", err)
+	}
+
+	return nil
+}
+
+// setSeatQuantity sets the quantity of the first item of a subscription in stripe and stores the updated subscription.
+// The quantity is set rather than incremented so that retries and concurrent additions do not bill for extra seats.
+func (s *StripeProvider) setSeatQuantity(subID, quantity int64) error {
+	sub, err := s.GetSubscriptionByID(subID)
+	if err != nil {
+		return err
+	}
+
+	if len(sub.Items) == 0 {
+		return ErrSubscriptionItemNotFound
+	}
+
+	itemID, err := s.itemProviderID(sub, &sub.Items[0])
+	if err != nil {
+		return err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:       stripe.String(itemID),
+				Quantity: stripe.Int64(quantity),
+			},
+		},
+	}
+
+	s.setIdempotencyKey(params)
+	ss, err := subscription.Update(sub.ProviderID, params)
+	if err != nil {
+		return err
+	}
+
+	updated, err := s.convertSubscription(ss)
+	if err != nil {
+		return err
+	}
+
+	// store the quantity right away, the webhook event arrives after the seat has been taken
+	return s.updateSubscriptionByProvider(updated, historySource{Event: SourceSeatBilling, At: time.Now()})
+}
+
+// maxSeats reads the max seats of a plan from the product metadata, where zero means seats are bought as quantity
+func maxSeats(metadata map[string]string) int64 {
+	n, _ := strconv.ParseInt(metadata[MetadataMaxSeats], 10, 64)
+	return n
+}
@@ -0,0 +1,25 @@
+package pay
+
+import "testing"
+
+func TestSeatsFree(t *testing.T) {
+	tests := []struct {
+		name  string
+		seats Seats
+		want  int64
+	}{
+		{"empty", Seats{Limit: 3}, 3},
+		{"partly used", Seats{Limit: 3, Used: 1}, 2},
+		{"full", Seats{Limit: 3, Used: 3}, 0},
+		{"over the limit after a downgrade", Seats{Limit: 2, Used: 5}, 0},
+		{"no seats", Seats{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.seats.Free(); got != tt.want {
+				t.Errorf("Free() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
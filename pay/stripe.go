@@ -3,13 +3,18 @@ package pay
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/cristosal/orm"
 	"github.com/stripe/stripe-go/v74"
+	portalsession "github.com/stripe/stripe-go/v74/billingportal/session"
 	"github.com/stripe/stripe-go/v74/checkout/session"
 	"github.com/stripe/stripe-go/v74/customer"
+	"github.com/stripe/stripe-go/v74/invoice"
 	"github.com/stripe/stripe-go/v74/price"
 	"github.com/stripe/stripe-go/v74/product"
+	"github.com/stripe/stripe-go/v74/subscription"
 )
 
 const ProviderStripe = "stripe"
@@ -19,15 +24,18 @@ var ErrCheckoutFailed = errors.New("checkout failed")
 type (
 	// StripeConfig configures StripeService with necessary credentials and callbacks
 	StripeConfig struct {
-		Repo          *Repo
-		Key           string
-		WebhookSecret string
+		Repo           *Repo
+		Key            string
+		WebhookSecret  string
+		PerSeatBilling bool          // raise the quantity of subscriptions when users are added beyond their seats
+		Dunning        DunningPolicy // how long past due subscriptions keep access
 	}
 
 	// StripeProvider interfaces with stripe for customer, plan and subscription data
 	StripeProvider struct {
 		*Repo
-		config *StripeConfig
+		config         *StripeConfig
+		idempotencyKey string
 	}
 )
 
@@ -44,25 +52,84 @@ func NewStripeProvider(config *StripeConfig) *StripeProvider {
 	}
 }
 
-// AddPlan directly in stripe
+// WithIdempotencyKey returns a copy of the provider which sends key as the idempotency key of the requests it makes to stripe.
+// Retrying a request with the same key will not create duplicate objects in stripe.
+func (s *StripeProvider) WithIdempotencyKey(key string) *StripeProvider {
+	cp := *s
+	cp.idempotencyKey = key
+	return &cp
+}
+
+// setIdempotencyKey adds the idempotency key to the params if one was given
+func (s *StripeProvider) setIdempotencyKey(p stripe.ParamsContainer) {
+	if s.idempotencyKey != "" {
+		p.GetParams().SetIdempotencyKey(s.idempotencyKey)
+	}
+}
+
+// AddPlan directly in stripe.
+// The plan is stored locally from the stripe response and p is updated with the stored values.
 func (s *StripeProvider) AddPlan(p *Plan) error {
-	_, err := product.New(&stripe.ProductParams{
+	if p.MaxSeats < 0 {
+		return ErrInvalidMaxSeats
+	}
+
+	params := &stripe.ProductParams{
 		Name:        stripe.String(p.Name),
 		Description: stripe.String(p.Description),
 		Active:      stripe.Bool(p.Active),
-	})
-	return err
+	}
+
+	params.AddMetadata(MetadataMaxSeats, strconv.FormatInt(p.MaxSeats, 10))
+	s.setIdempotencyKey(params)
+	prod, err := product.New(params)
+	if err != nil {
+		return err
+	}
+
+	pl := s.convertProduct(prod)
+	if err := s.upsertPlan(pl); err != nil {
+		return err
+	}
+
+	*p = *pl
+	return nil
 }
 
-// UpdatePlan in stripe
+// UpdatePlan in stripe.
+// The stored plan is updated from the stripe response and p is updated with the stored values.
 func (s *StripeProvider) UpdatePlan(p *Plan) error {
-	_, err := product.Update(p.ProviderID, &stripe.ProductParams{
+	if p.ProviderID == "" {
+		return errors.New("missing plan provider id")
+	}
+
+	if p.MaxSeats < 0 {
+		return ErrInvalidMaxSeats
+	}
+
+	params := &stripe.ProductParams{
 		Name:        stripe.String(p.Name),
 		Description: stripe.String(p.Description),
 		Active:      stripe.Bool(p.Active),
-	})
+	}
 
-	return err
+	params.AddMetadata(MetadataMaxSeats, strconv.FormatInt(p.MaxSeats, 10))
+	prod, err := product.Update(p.ProviderID, params)
+	if err != nil {
+		return err
+	}
+
+	pl := s.convertProduct(prod)
+	if err := s.upsertPlan(pl); err != nil {
+		return err
+	}
+
+	if err := s.syncProductEntitlements(prod); err != nil {
+		return err
+	}
+
+	*p = *pl
+	return nil
 }
 
 // RemovePlan from stripe
@@ -71,7 +138,8 @@ func (s *StripeProvider) RemovePlanByProviderID(providerID string) error {
 	return err
 }
 
-// AddPrice directly in stripe
+// AddPrice directly in stripe.
+// The price is stored locally from the stripe response and p is updated with the stored values.
 func (s *StripeProvider) AddPrice(p *Price) error {
 	var sched string
 	switch p.Schedule {
@@ -79,6 +147,12 @@ func (s *StripeProvider) AddPrice(p *Price) error {
 		sched = string(stripe.PriceRecurringIntervalYear)
 	case PricingMonthly:
 		sched = string(stripe.PriceRecurringIntervalMonth)
+	case PricingOnce:
+		if p.TrialDays > 0 {
+			return ErrTrialOnOneTimePrice
+		}
+	default:
+		return ErrInvalidSchedule
 	}
 
 	pl, err := s.GetPlanByID(p.PlanID)
@@ -86,41 +160,168 @@ func (s *StripeProvider) AddPrice(p *Price) error {
 		return fmt.Errorf("plan with id %d not found", p.PlanID)
 	}
 
-	_, err = price.New(&stripe.PriceParams{
+	params := &stripe.PriceParams{
 		Currency:   stripe.String(p.Currency),
 		UnitAmount: stripe.Int64(p.Amount),
 		Product:    stripe.String(pl.ProviderID),
-		Recurring: &stripe.PriceRecurringParams{
+	}
+
+	// prices without recurring params are one-time prices
+	if sched != "" {
+		params.Recurring = &stripe.PriceRecurringParams{
 			Interval:        stripe.String(sched),
 			TrialPeriodDays: stripe.Int64(int64(p.TrialDays)),
 			IntervalCount:   stripe.Int64(1),
-		},
-	})
+		}
+	}
 
-	return err
+	if p.Nickname != "" {
+		params.Nickname = stripe.String(p.Nickname)
+	}
+
+	for k, v := range p.Metadata {
+		params.AddMetadata(k, v)
+	}
+
+	s.setIdempotencyKey(params)
+	stripePrice, err := price.New(params)
+	if err != nil {
+		return err
+	}
+
+	pr, err := s.convertPrice(stripePrice)
+	if err != nil {
+		return err
+	}
+
+	if err := s.upsertPrice(pr); err != nil {
+		return err
+	}
+
+	*p = *pr
+	return nil
 }
 
-// AddCustomer directly in stripe
+// UpdatePrice updates the active flag, nickname and metadata of the price in stripe.
+// Stripe does not allow changing the amount, currency or schedule of a price, create a new price instead.
+// The stored price is updated from the stripe response and p is updated with the stored values.
+func (s *StripeProvider) UpdatePrice(p *Price) error {
+	if p.ProviderID == "" {
+		return errors.New("missing price provider id")
+	}
+
+	params := &stripe.PriceParams{
+		Active:   stripe.Bool(p.Active),
+		Nickname: stripe.String(p.Nickname),
+	}
+
+	for k, v := range p.Metadata {
+		params.AddMetadata(k, v)
+	}
+
+	// keys are removed from stripe metadata by setting them to an empty value
+	if prev, err := s.GetPriceByProvider(ProviderStripe, p.ProviderID); err == nil {
+		for k := range prev.Metadata {
+			if _, exists := p.Metadata[k]; !exists {
+				params.AddMetadata(k, "")
+			}
+		}
+	}
+
+	stripePrice, err := price.Update(p.ProviderID, params)
+	if err != nil {
+		return err
+	}
+
+	pr, err := s.convertPrice(stripePrice)
+	if err != nil {
+		return err
+	}
+
+	if err := s.upsertPrice(pr); err != nil {
+		return err
+	}
+
+	*p = *pr
+	return nil
+}
+
+// AddCustomer directly in stripe.
+// The customer is stored locally from the stripe response and c is updated with the stored values.
 func (s *StripeProvider) AddCustomer(c *Customer) error {
-	_, err := customer.New(&stripe.CustomerParams{
+	params := &stripe.CustomerParams{
 		Name:  stripe.String(c.Name),
 		Email: stripe.String(c.Email),
-	})
-	return err
+	}
+
+	s.setIdempotencyKey(params)
+	cust, err := customer.New(params)
+	if err != nil {
+		return err
+	}
+
+	cu := s.convertCustomer(cust)
+	if err := s.upsertCustomer(cu); err != nil {
+		return err
+	}
+
+	*c = *cu
+	return nil
 }
 
-// Update Customer directly in stripe
+// Update Customer directly in stripe.
+// The stored customer is updated from the stripe response and c is updated with the stored values.
 func (s *StripeProvider) UpdateCustomer(c *Customer) error {
 	if c.ProviderID == "" {
 		return errors.New("missing customer provider id")
 	}
 
-	_, err := customer.Update(c.ProviderID, &stripe.CustomerParams{
+	cust, err := customer.Update(c.ProviderID, &stripe.CustomerParams{
 		Name:  stripe.String(c.Name),
 		Email: stripe.String(c.Email),
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	cu := s.convertCustomer(cust)
+	if err := s.upsertCustomer(cu); err != nil {
+		return err
+	}
+
+	*c = *cu
+	return nil
+}
+
+// ListInvoicesByCustomerID returns the invoices of a customer directly from stripe, newest first
+func (s *StripeProvider) ListInvoicesByCustomerID(customerID int64) ([]Invoice, error) {
+	cust, err := s.GetCustomerByID(customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var invoices []Invoice
+	it := invoice.List(&stripe.InvoiceListParams{Customer: stripe.String(cust.ProviderID)})
+	for it.Next() {
+		inv := it.Invoice()
+		invoices = append(invoices, Invoice{
+			ProviderID: inv.ID,
+			Number:     inv.Number,
+			Status:     string(inv.Status),
+			Currency:   string(inv.Currency),
+			Total:      inv.Total,
+			AmountDue:  inv.AmountDue,
+			AmountPaid: inv.AmountPaid,
+			URL:        inv.HostedInvoiceURL,
+			CreatedAt:  time.Unix(inv.Created, 0),
+		})
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
 }
 
 // RemoveCustomer directly in stripe
@@ -143,50 +344,189 @@ func (s *StripeProvider) VerifyCheckout(sessionID string) error {
 	return nil
 }
 
+// MetadataPriceID is the payment metadata key holding the id of the one-time price that was bought
+const MetadataPriceID = "cent_price_id"
+
+var (
+	ErrInvalidSchedule     = errors.New("invalid pricing schedule")
+	ErrTrialOnOneTimePrice = errors.New("one-time prices can not have a trial")
+)
+
 // CheckoutRequest
 type CheckoutRequest struct {
-	CustomerID  int64
-	PriceID     int64
-	RedirectURL string
+	CustomerID          int64
+	Email               string // finds or creates the customer when CustomerID is not set
+	Name                string // name of the customer created for Email
+	PriceID             int64  // bought along with the line items when set
+	Quantity            int64  // quantity of PriceID, defaults to 1
+	LineItems           []CheckoutLineItem
+	RedirectURL         string // where the customer is sent after paying
+	CancelURL           string // where the customer is sent when leaving checkout without paying
+	AllowPromotionCodes bool   // lets the customer enter a promotion code, can not be combined with Coupon
+	Coupon              string // provider id of a coupon to apply
+	AutomaticTax        bool
+	ClientReferenceID   string
+	Metadata            Metadata // attached to the checkout session and the resulting subscription or payment
 }
 
-// Checkout returns the url that a user has to visit in order to complete payment
-// it registers the customer if it was unavailable
+// CheckoutLineItem is a price bought in a checkout
+type CheckoutLineItem struct {
+	PriceID  int64
+	Quantity int64 // defaults to 1
+}
+
+var (
+	ErrMissingCustomer          = errors.New("checkout needs a customer id or email")
+	ErrEmptyCheckout            = errors.New("checkout has no line items")
+	ErrInvalidQuantity          = errors.New("quantity must be positive")
+	ErrPromotionCodesWithCoupon = errors.New("promotion codes can not be allowed when a coupon is applied")
+)
+
+// lineItems returns PriceID followed by the line items of the request, defaulting quantities to 1
+func (request *CheckoutRequest) lineItems() ([]CheckoutLineItem, error) {
+	var items []CheckoutLineItem
+	if request.PriceID != 0 {
+		items = append(items, CheckoutLineItem{PriceID: request.PriceID, Quantity: request.Quantity})
+	}
+
+	items = append(items, request.LineItems...)
+	if len(items) == 0 {
+		return nil, ErrEmptyCheckout
+	}
+
+	for i := range items {
+		if items[i].Quantity == 0 {
+			items[i].Quantity = 1
+		}
+
+		if items[i].Quantity < 0 {
+			return nil, ErrInvalidQuantity
+		}
+	}
+
+	return items, nil
+}
+
+// Checkout returns the url that a user has to visit in order to complete payment.
+// The checkout creates a subscription when any of the prices is recurring, otherwise the prices are paid for once.
+// When the request has an email instead of a customer id, the customer is registered if it was unavailable
 func (s *StripeProvider) Checkout(request *CheckoutRequest) (url string, err error) {
-	customer, err := s.GetCustomerByID(request.CustomerID)
-	if err != nil {
+	if request.AllowPromotionCodes && request.Coupon != "" {
+		err = ErrPromotionCodesWithCoupon
 		return
 	}
 
-	price, err := s.GetPriceByID(request.PriceID)
+	items, err := request.lineItems()
 	if err != nil {
 		return
 	}
 
-	var trialEnd *int64 = nil
+	var customer *Customer
+	switch {
+	case request.CustomerID != 0:
+		customer, err = s.GetCustomerByID(request.CustomerID)
+	case request.Email != "":
+		customer, err = s.getOrAddCustomerByEmail(request.Email, request.Name)
+	default:
+		err = ErrMissingCustomer
+	}
 
-	if price.TrialDays > 0 {
-		// we add one day of grace so that stripe displays the correct amount.
-		// since trial end is calculated from current time, being one second off will result in days -1 being displayed in stripe checkout
-		trialEnd = stripe.Int64(price.TrialEnd().Add(time.Hour * 24).Unix())
+	if err != nil {
+		return
 	}
 
 	params := &stripe.CheckoutSessionParams{
-		Customer:                stripe.String(customer.ProviderID),
-		SuccessURL:              stripe.String(request.RedirectURL),
-		Mode:                    stripe.String(string(stripe.CheckoutSessionModeSubscription)),
-		PaymentMethodCollection: stripe.String("if_required"),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String(price.ProviderID),
-				Quantity: stripe.Int64(1),
-			},
-		},
-		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+		Customer:   stripe.String(customer.ProviderID),
+		SuccessURL: stripe.String(request.RedirectURL),
+	}
+
+	var (
+		recurring bool
+		trialDays int
+		prices    []*Price
+	)
+
+	for _, item := range items {
+		price, err := s.GetPriceByID(item.PriceID)
+		if err != nil {
+			return "", err
+		}
+
+		if price.Schedule != PricingOnce {
+			recurring = true
+		}
+
+		if price.TrialDays > trialDays {
+			trialDays = price.TrialDays
+		}
+
+		prices = append(prices, price)
+		params.LineItems = append(params.LineItems, &stripe.CheckoutSessionLineItemParams{
+			Price:    stripe.String(price.ProviderID),
+			Quantity: stripe.Int64(item.Quantity),
+		})
+	}
+
+	if request.CancelURL != "" {
+		params.CancelURL = stripe.String(request.CancelURL)
+	}
+
+	if request.AllowPromotionCodes {
+		params.AllowPromotionCodes = stripe.Bool(true)
+	}
+
+	if request.Coupon != "" {
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{
+			{Coupon: stripe.String(request.Coupon)},
+		}
+	}
+
+	if request.AutomaticTax {
+		params.AutomaticTax = &stripe.CheckoutSessionAutomaticTaxParams{Enabled: stripe.Bool(true)}
+		// the address entered during checkout is needed to calculate the tax of an existing customer
+		params.CustomerUpdate = &stripe.CheckoutSessionCustomerUpdateParams{Address: stripe.String("auto")}
+	}
+
+	if request.ClientReferenceID != "" {
+		params.ClientReferenceID = stripe.String(request.ClientReferenceID)
+	}
+
+	for k, v := range request.Metadata {
+		params.AddMetadata(k, v)
+	}
+
+	if !recurring {
+		// one-time prices are paid for directly. A single price is attached so that the payment can be recorded against it
+		params.Mode = stripe.String(string(stripe.CheckoutSessionModePayment))
+		params.PaymentIntentData = &stripe.CheckoutSessionPaymentIntentDataParams{
+			Metadata: make(map[string]string),
+		}
+
+		for k, v := range request.Metadata {
+			params.PaymentIntentData.Metadata[k] = v
+		}
+
+		if len(prices) == 1 {
+			params.PaymentIntentData.Metadata[MetadataPriceID] = strconv.FormatInt(prices[0].ID, 10)
+		}
+	} else {
+		var trialEnd *int64 = nil
+
+		if trialDays > 0 {
+			// we add one day of grace so that stripe displays the correct amount.
+			// since trial end is calculated from current time, being one second off will result in days -1 being displayed in stripe checkout
+			trialEnd = stripe.Int64(time.Now().AddDate(0, 0, trialDays+1).Unix())
+		}
+
+		params.Mode = stripe.String(string(stripe.CheckoutSessionModeSubscription))
+		params.PaymentMethodCollection = stripe.String("if_required")
+		params.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{
 			TrialEnd: trialEnd,
-		},
+			Metadata: request.Metadata,
+		}
 	}
 
+	s.setIdempotencyKey(params)
 	sess, err := session.New(params)
 	if err != nil {
 		return
@@ -196,6 +536,228 @@ func (s *StripeProvider) Checkout(request *CheckoutRequest) (url string, err err
 	return
 }
 
+// getOrAddCustomerByEmail returns the customer with the email, looking it up in stripe when it is not stored locally.
+// Customers that do not exist are created in stripe and stored right away
+func (s *StripeProvider) getOrAddCustomerByEmail(email, name string) (*Customer, error) {
+	c, err := s.GetCustomerByEmail(email)
+	if err == nil {
+		return c, nil
+	}
+
+	if !errors.Is(err, orm.ErrNotFound) {
+		return nil, err
+	}
+
+	// the customer may have been created in stripe before the webhook event reached us
+	it := customer.List(&stripe.CustomerListParams{Email: stripe.String(email)})
+	if it.Next() {
+		c := s.convertCustomer(it.Customer())
+		if err := s.upsertCustomer(c); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	// the idempotency key of the checkout can not be reused for another kind of request
+	p := s
+	if s.idempotencyKey != "" {
+		p = s.WithIdempotencyKey(s.idempotencyKey + "-customer")
+	}
+
+	c = &Customer{Email: email, Name: name}
+	if err := p.AddCustomer(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// PortalRequest asks for a billing portal session for a customer
+type PortalRequest struct {
+	CustomerID int64
+	ReturnURL  string
+}
+
+// CreatePortalSession returns the url of the billing portal where the customer can update payment methods and download invoices.
+// The customer is sent to returnURL when leaving the portal
+func (s *StripeProvider) CreatePortalSession(customerID int64, returnURL string) (url string, err error) {
+	customer, err := s.GetCustomerByID(customerID)
+	if err != nil {
+		return
+	}
+
+	params := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(customer.ProviderID),
+		ReturnURL: stripe.String(returnURL),
+	}
+
+	s.setIdempotencyKey(params)
+	sess, err := portalsession.New(params)
+	if err != nil {
+		return
+	}
+
+	url = sess.URL
+	return
+}
+
+// Proration behaviors when changing the price of a subscription
+const (
+	ProrationCreate        = "create_prorations" // credit or charge the difference on the next invoice
+	ProrationNone          = "none"
+	ProrationAlwaysInvoice = "always_invoice" // invoice the difference immediately
+)
+
+var ErrInvalidProration = errors.New("invalid proration behavior")
+
+// CancelSubscriptionRequest cancels a subscription now or at the end of the current period
+type CancelSubscriptionRequest struct {
+	SubscriptionID int64
+	AtPeriodEnd    bool
+}
+
+// ChangePriceRequest moves a subscription item to another price
+type ChangePriceRequest struct {
+	SubscriptionID int64
+	ItemID         int64 // subscription item to change, defaults to the first item
+	PriceID        int64
+	Proration      string // defaults to ProrationCreate
+}
+
+// CancelSubscription cancels the subscription at stripe. The local copy is updated by the webhook
+func (s *StripeProvider) CancelSubscription(req *CancelSubscriptionRequest) error {
+	sub, err := s.GetSubscriptionByID(req.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	if req.AtPeriodEnd {
+		params := &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(true)}
+		s.setIdempotencyKey(params)
+		_, err = subscription.Update(sub.ProviderID, params)
+		return err
+	}
+
+	params := &stripe.SubscriptionCancelParams{}
+	s.setIdempotencyKey(params)
+	_, err = subscription.Cancel(sub.ProviderID, params)
+	return err
+}
+
+// PauseSubscription pauses payment collection, voiding invoices until the subscription is resumed
+func (s *StripeProvider) PauseSubscription(subID int64) error {
+	sub, err := s.GetSubscriptionByID(subID)
+	if err != nil {
+		return err
+	}
+
+	params := &stripe.SubscriptionParams{
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorVoid)),
+		},
+	}
+
+	s.setIdempotencyKey(params)
+	_, err = subscription.Update(sub.ProviderID, params)
+	return err
+}
+
+// itemProviderID returns the stripe id of a subscription item
+func (s *StripeProvider) itemProviderID(sub *Subscription, item *SubscriptionItem) (string, error) {
+	if item.ProviderID != "" {
+		return item.ProviderID, nil
+	}
+
+	// items created by the migration have no provider id until the subscription is synced
+	ss, err := subscription.Get(sub.ProviderID, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ss.Items.Data) == 0 {
+		return "", ErrSubscriptionItemNotFound
+	}
+
+	return ss.Items.Data[0].ID, nil
+}
+
+// ResumeSubscription resumes payment collection of a paused subscription and undoes a scheduled cancellation
+func (s *StripeProvider) ResumeSubscription(subID int64) error {
+	sub, err := s.GetSubscriptionByID(subID)
+	if err != nil {
+		return err
+	}
+
+	params := &stripe.SubscriptionParams{}
+	params.AddExtra("pause_collection", "")
+	if sub.CancelAtPeriodEnd {
+		params.CancelAtPeriodEnd = stripe.Bool(false)
+	}
+
+	s.setIdempotencyKey(params)
+	_, err = subscription.Update(sub.ProviderID, params)
+	return err
+}
+
+// ChangeSubscriptionPrice upgrades or downgrades a subscription item to another price
+func (s *StripeProvider) ChangeSubscriptionPrice(req *ChangePriceRequest) error {
+	if req.Proration == "" {
+		req.Proration = ProrationCreate
+	}
+
+	switch req.Proration {
+	case ProrationCreate, ProrationNone, ProrationAlwaysInvoice:
+	default:
+		return ErrInvalidProration
+	}
+
+	sub, err := s.GetSubscriptionByID(req.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	pr, err := s.GetPriceByID(req.PriceID)
+	if err != nil {
+		return err
+	}
+
+	var item *SubscriptionItem
+	for i := range sub.Items {
+		if req.ItemID == 0 || sub.Items[i].ID == req.ItemID {
+			item = &sub.Items[i]
+			break
+		}
+	}
+
+	if item == nil {
+		return ErrSubscriptionItemNotFound
+	}
+
+	itemID, err := s.itemProviderID(sub, item)
+	if err != nil {
+		return err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(itemID),
+				Price: stripe.String(pr.ProviderID),
+			},
+		},
+		ProrationBehavior: stripe.String(req.Proration),
+	}
+
+	s.setIdempotencyKey(params)
+	_, err = subscription.Update(sub.ProviderID, params)
+	return err
+}
+
 // this should go here
 func (StripeProvider) convertPricingSchedule(p *stripe.Price) PricingSchedule {
 	switch p.Type {
@@ -26,6 +26,14 @@ func (s *StripeProvider) Sync() error {
 		return fmt.Errorf("error syncing prices: %w", err)
 	}
 
+	if err := s.syncCoupons(); err != nil {
+		return fmt.Errorf("error syncing coupons: %w", err)
+	}
+
+	if err := s.syncPromotionCodes(); err != nil {
+		return fmt.Errorf("error syncing promotion codes: %w", err)
+	}
+
 	if err := s.syncSubscriptions(); err != nil {
 		return fmt.Errorf("error syncing subscriptions: %w", err)
 	}
@@ -88,15 +96,19 @@ func (s *StripeProvider) syncCustomers() error {
 		if found == nil {
 			if err := s.addCustomer(c); err != nil {
 				log.Printf("error while adding stripe customer with id %s: %v", c.ProviderID, err)
+				continue
+			}
+		} else {
+			c.ID = found.ID
+			if c.Name != found.Name || c.Email != found.Email {
+				if err := s.updateCustomerByProvider(c); err != nil {
+					log.Printf("error while updating stripe customer with id %s: %v", c.ProviderID, err)
+				}
 			}
-			continue
 		}
 
-		c.ID = found.ID
-		if c.Name != found.Name || c.Email != found.Email {
-			if err := s.updateCustomerByProvider(c); err != nil {
-				log.Printf("error while updating stripe customer with id %s: %v", c.ProviderID, err)
-			}
+		if err := s.syncCustomerPaymentMethods(cust, c.ID); err != nil {
+			log.Printf("error while syncing payment methods of stripe customer with id %s: %v", c.ProviderID, err)
 		}
 	}
 
@@ -120,19 +132,18 @@ func (s *StripeProvider) syncPlans() error {
 		_, err := s.GetPlanByProviderID(ProviderStripe, p.ID)
 
 		if errors.Is(err, orm.ErrNotFound) {
-			if err := s.addPlan(pl); err != nil {
-				log.Printf("error while adding plan %s: %v", p.ID, err)
-			}
-			continue
+			err = s.addPlan(pl)
+		} else if err == nil {
+			err = s.updatePlanByProvider(pl)
 		}
 
 		if err != nil {
-			log.Printf("error while getting plan %s: %v", p.ID, err)
+			log.Printf("error syncing plan %s: %v", p.ID, err)
 			continue
 		}
 
-		if err := s.updatePlanByProvider(pl); err != nil {
-			log.Printf("error updating plan %s: %v", pl.ProviderID, err)
+		if err := s.syncProductEntitlements(p); err != nil {
+			log.Printf("error syncing entitlements of plan %s: %v", p.ID, err)
 		}
 	}
 
@@ -154,12 +165,13 @@ func (s *StripeProvider) syncSubscriptions() error {
 		subscr, err := s.convertSubscription(sub)
 		if err != nil {
 			log.Printf("error converting subscription %s: %v", sub.ID, err)
+			continue
 		}
 
 		_, err = s.GetSubscriptionByProvider(ProviderStripe, sub.ID)
 		if errors.Is(err, orm.ErrNotFound) {
 			// we add it
-			if err := s.addSubscription(subscr); err != nil {
+			if err := s.addSubscription(subscr, syncSource()); err != nil {
 				log.Printf("error adding subscription %s: %v", subscr.ProviderID, err)
 			}
 			continue
@@ -170,7 +182,7 @@ func (s *StripeProvider) syncSubscriptions() error {
 			continue
 		}
 
-		if err := s.updateSubscriptionByProvider(subscr); err != nil {
+		if err := s.updateSubscriptionByProvider(subscr, syncSource()); err != nil {
 			log.Printf("error updating subscription %s: %v", subscr.ProviderID, err)
 			continue
 		}
@@ -0,0 +1,401 @@
+package pay
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cristosal/orm"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/usagerecord"
+)
+
+// MetadataMeter is the price metadata key naming the meter of a metered price.
+// Metered prices without it are metered under their lookup key, or else their id.
+const MetadataMeter = "cent_meter"
+
+// UsageBatchSize is the most usage records reported at once
+const UsageBatchSize = 1000
+
+// UsageClaimTimeout is how long records claimed for reporting wait before another reporter claims them again
+const UsageClaimTimeout = 10 * time.Minute
+
+// UsageReportAttempts is how often a batch is sent to stripe before its records are marked as not reported
+const UsageReportAttempts = 5
+
+var (
+	ErrMeterRequired         = errors.New("meter is required")
+	ErrMeterNotFound         = errors.New("no active subscription is billed for the meter")
+	ErrInvalidUsageTimestamp = errors.New("usage timestamp is in the future")
+	ErrUsagePeriodClosed     = errors.New("usage is before the current billing period")
+)
+
+type (
+	// UsageRequest queries the usage of a subscription per meter.
+	// The current period of the subscription is used when no range is given.
+	UsageRequest struct {
+		SubscriptionID int64
+		Meter          string // only the usage of this meter when set
+		Since          time.Time
+		Until          time.Time
+	}
+
+	// Usage is the quantity recorded for a meter within a period
+	Usage struct {
+		SubscriptionID int64
+		Meter          string
+		Since          time.Time
+		Until          time.Time
+		Quantity       int64
+		Reported       int64 // part of the quantity that was reported to the provider
+	}
+)
+
+// AddUsageRecord buffers usage of a meter until it is reported.
+// The usage is recorded against the subscription if one is given, otherwise against the newest active subscription of the user that is billed for the meter.
+// Records with an idempotency key that was already used are set to the record stored before.
+func (r *Repo) AddUsageRecord(rec *UsageRecord) error {
+	rec.Meter = strings.TrimSpace(rec.Meter)
+	if rec.Meter == "" {
+		return ErrMeterRequired
+	}
+
+	if rec.Quantity <= 0 {
+		return ErrInvalidQuantity
+	}
+
+	now := time.Now()
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = now
+	}
+
+	if rec.Timestamp.After(now) {
+		return ErrInvalidUsageTimestamp
+	}
+
+	if found, err := r.usageRecordByKey(rec); found || err != nil {
+		return err
+	}
+
+	subID, itemID, err := r.meterItem(rec.SubscriptionID, rec.Username, rec.Meter)
+	if err != nil {
+		return err
+	}
+
+	rec.SubscriptionID = subID
+	rec.SubscriptionItemID = itemID
+	rec.CreatedAt = now
+	rec.ReportingBatch = ""
+	rec.ClaimedAt = nil
+	rec.ReportAttempts = 0
+	rec.ReportedAt = nil
+	rec.Error = ""
+	if err := orm.Add(r.db, rec); err != nil {
+		// a concurrent request with the same key inserted first and the unique index rejected this one
+		if found, _ := r.usageRecordByKey(rec); found {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// usageRecordByKey sets rec to the stored record with the same idempotency key and reports whether there was one
+func (r *Repo) usageRecordByKey(rec *UsageRecord) (bool, error) {
+	if rec.IdempotencyKey == "" {
+		return false, nil
+	}
+
+	var prev UsageRecord
+	err := orm.Get(r.db, &prev, "WHERE idempotency_key = $1", rec.IdempotencyKey)
+	if errors.Is(err, orm.ErrNotFound) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	*rec = prev
+	return true, nil
+}
+
+// meterItem returns the active subscription and its item that are billed for the meter.
+// The subscription is either the one given or the newest of the user.
+func (r *Repo) meterItem(subID int64, username, meter string) (int64, int64, error) {
+	var (
+		filter string
+		arg    any
+	)
+
+	switch {
+	case subID != 0:
+		filter = "s.id = $2"
+		arg = subID
+	case username != "":
+		filter = fmt.Sprintf("EXISTS (SELECT 1 FROM %s su WHERE su.subscription_id = s.id AND su.username = $2)", orm.TableName(&SubscriptionUser{}))
+		arg = username
+	default:
+		return 0, 0, ErrSubscriptionNotFound
+	}
+
+	q := fmt.Sprintf(`
+		SELECT s.id, si.id
+		FROM %s si
+		INNER JOIN %s pr ON pr.id = si.price_id
+		INNER JOIN %s s ON s.id = si.subscription_id AND s.active
+		WHERE pr.meter = $1 AND %s
+		ORDER BY s.created_at DESC, si.id
+		LIMIT 1`,
+		orm.TableName(&SubscriptionItem{}),
+		orm.TableName(&Price{}),
+		orm.TableName(&Subscription{}),
+		filter,
+	)
+
+	var itemID int64
+	if err := r.db.QueryRow(q, meter, arg).Scan(&subID, &itemID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, ErrMeterNotFound
+		}
+
+		return 0, 0, err
+	}
+
+	return subID, itemID, nil
+}
+
+// ListUsage returns the usage of a subscription per meter within the requested period
+func (r *Repo) ListUsage(req *UsageRequest) ([]Usage, error) {
+	if req.Since.IsZero() || req.Until.IsZero() {
+		sub, err := r.GetSubscriptionByID(req.SubscriptionID)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Since.IsZero() {
+			req.Since = sub.CurrentPeriodStart
+		}
+
+		if req.Until.IsZero() {
+			req.Until = sub.CurrentPeriodEnd
+		}
+	}
+
+	q := fmt.Sprintf(`
+		SELECT subscription_id, meter, $2::timestamptz, $3::timestamptz, SUM(quantity),
+			COALESCE(SUM(quantity) FILTER (WHERE reported_at IS NOT NULL AND error = ''), 0)
+		FROM %s
+		WHERE subscription_id = $1 AND timestamp >= $2 AND timestamp < $3 AND ($4 = '' OR meter = $4)
+		GROUP BY subscription_id, meter
+		ORDER BY meter`,
+		orm.TableName(&UsageRecord{}),
+	)
+
+	var usage []Usage
+	if err := orm.Query(r.db, &usage, q, req.SubscriptionID, req.Since, req.Until, req.Meter); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// usageBatch are the records of a subscription item claimed for the same report
+type usageBatch struct {
+	id       string
+	itemID   int64
+	attempts int // times the batch was claimed, more than one when it is retried
+	records  []UsageRecord
+}
+
+// ReportUsage reports the buffered usage records to stripe and returns how many were reported.
+// The records of a subscription item are summed into a single stripe usage record, so metered prices should aggregate usage by sum.
+// Records from before the current period of their subscription can no longer be billed and are marked with ErrUsagePeriodClosed.
+//
+// Records are claimed for a reporting batch before stripe is called and marked as reported afterwards, so no transaction is held open
+// while waiting for stripe. Records whose claim is older than UsageClaimTimeout are claimed again under the same batch,
+// which makes the retry use the idempotency key of the first attempt.
+func (s *StripeProvider) ReportUsage() (int, error) {
+	recs, err := s.claimUsage()
+	if err != nil {
+		return 0, err
+	}
+
+	var batches []usageBatch
+	index := make(map[string]int)
+	for _, rec := range recs {
+		key := fmt.Sprintf("%s-%d", rec.ReportingBatch, rec.SubscriptionItemID)
+		i, ok := index[key]
+		if !ok {
+			i = len(batches)
+			index[key] = i
+			batches = append(batches, usageBatch{id: rec.ReportingBatch, itemID: rec.SubscriptionItemID})
+		}
+
+		batches[i].records = append(batches[i].records, rec)
+		batches[i].attempts = max(batches[i].attempts, rec.ReportAttempts)
+	}
+
+	var (
+		reported int
+		errs     []error
+	)
+
+	for i := range batches {
+		n, err := s.reportUsageBatch(&batches[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error reporting usage of subscription item %d: %w", batches[i].itemID, err))
+		}
+
+		reported += n
+	}
+
+	return reported, errors.Join(errs...)
+}
+
+// claimUsage claims unreported records for a new reporting batch, along with records whose claim timed out.
+// Skipping locked records keeps concurrent reporters from claiming the same usage.
+func (s *StripeProvider) claimUsage() ([]UsageRecord, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	var (
+		rec   UsageRecord
+		now   = time.Now()
+		batch = hex.EncodeToString(b)
+	)
+
+	q := fmt.Sprintf(`
+		UPDATE %s SET
+			reporting_batch = CASE WHEN reporting_batch = '' THEN $1 ELSE reporting_batch END,
+			claimed_at = $2,
+			report_attempts = report_attempts + 1
+		WHERE id IN (
+			SELECT id FROM %s
+			WHERE reported_at IS NULL AND (reporting_batch = '' OR claimed_at < $3)
+			ORDER BY id LIMIT $4 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING %s`,
+		rec.TableName(),
+		rec.TableName(),
+		orm.Columns(&rec).List(),
+	)
+
+	var recs []UsageRecord
+	if err := orm.Query(s.db, &recs, q, batch, now, now.Add(-UsageClaimTimeout), UsageBatchSize); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(recs, func(i, j int) bool { return recs[i].ID < recs[j].ID })
+	return recs, nil
+}
+
+// reportUsageBatch reports the records of a batch as one stripe usage record and marks them as reported.
+// Records that stripe rejects are marked with the error instead, other errors leave them to be retried once their claim times out.
+func (s *StripeProvider) reportUsageBatch(b *usageBatch) (int, error) {
+	var item SubscriptionItem
+	if err := orm.Get(s.db, &item, "WHERE id = $1", b.itemID); err != nil {
+		return 0, err
+	}
+
+	var sub Subscription
+	if err := orm.Get(s.db, &sub, "WHERE id = $1", item.SubscriptionID); err != nil {
+		return 0, err
+	}
+
+	var (
+		closed   []int64
+		open     []int64
+		quantity int64
+		lastAt   time.Time
+	)
+
+	// retries send the payload of the first attempt, which was split before any period rolled over,
+	// because stripe rejects a different payload under the same idempotency key
+	for _, rec := range b.records {
+		if b.attempts == 1 && rec.Timestamp.Before(sub.CurrentPeriodStart) {
+			closed = append(closed, rec.ID)
+			continue
+		}
+
+		open = append(open, rec.ID)
+		quantity += rec.Quantity
+		if rec.Timestamp.After(lastAt) {
+			lastAt = rec.Timestamp
+		}
+	}
+
+	if err := markUsageReported(s.db, closed, ErrUsagePeriodClosed.Error()); err != nil {
+		return 0, err
+	}
+
+	if len(open) == 0 {
+		return 0, nil
+	}
+
+	if b.attempts > UsageReportAttempts {
+		return 0, markUsageReported(s.db, open, fmt.Sprintf("not reported after %d attempts", UsageReportAttempts))
+	}
+
+	itemID, err := s.itemProviderID(&sub, &item)
+	if err != nil {
+		return 0, err
+	}
+
+	params := &stripe.UsageRecordParams{
+		SubscriptionItem: stripe.String(itemID),
+		Action:           stripe.String("increment"),
+		Quantity:         stripe.Int64(quantity),
+		Timestamp:        stripe.Int64(lastAt.Unix()),
+	}
+
+	// the stored batch identifies the report, so a batch that was reported but not marked is not reported again
+	params.SetIdempotencyKey(fmt.Sprintf("cent-usage-%s-%d", b.id, b.itemID))
+	if _, err := usagerecord.New(params); err != nil {
+		var se *stripe.Error
+		if errors.As(err, &se) && (se.Type == stripe.ErrorTypeInvalidRequest || se.Type == stripe.ErrorTypeIdempotency) {
+			return 0, markUsageReported(s.db, open, se.Msg)
+		}
+
+		return 0, err
+	}
+
+	if err := markUsageReported(s.db, open, ""); err != nil {
+		return 0, err
+	}
+
+	return len(open), nil
+}
+
+// markUsageReported marks usage records as handled, with the reason they were not billed if they could not be reported
+func markUsageReported(tx orm.QuerierExecuter, ids []int64, reason string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	q := fmt.Sprintf("UPDATE %s SET reported_at = $1, error = $2 WHERE id = ANY($3)", orm.TableName(&UsageRecord{}))
+	_, err := tx.Exec(q, time.Now(), reason, ids)
+	return err
+}
+
+// priceMeter returns the meter of a metered price
+func priceMeter(p *stripe.Price) string {
+	if m := strings.TrimSpace(p.Metadata[MetadataMeter]); m != "" {
+		return m
+	}
+
+	if p.LookupKey != "" {
+		return p.LookupKey
+	}
+
+	return p.ID
+}
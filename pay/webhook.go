@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/stripe/stripe-go/v74"
@@ -43,11 +44,25 @@ func (s *StripeProvider) Webhook() http.HandlerFunc {
 			case "customer.deleted":
 				err = s.handleCustomerDeleted(event.Data)
 			case "customer.subscription.created":
-				err = s.handleSubscriptionCreated(event.Data)
+				err = s.handleSubscriptionCreated(&event)
 			case "customer.subscription.updated":
-				err = s.handleSubscriptionUpdated(event.Data)
+				err = s.handleSubscriptionUpdated(&event)
 			case "customer.subscription.deleted":
-				err = s.handleSubscriptionDeleted(event.Data)
+				err = s.handleSubscriptionDeleted(&event)
+			case "coupon.created", "coupon.updated":
+				err = s.handleCouponUpserted(event.Data)
+			case "coupon.deleted":
+				err = s.handleCouponDeleted(event.Data)
+			case "promotion_code.created", "promotion_code.updated":
+				err = s.handlePromotionCodeUpserted(event.Data)
+			case "payment_method.attached", "payment_method.updated", "payment_method.automatically_updated":
+				err = s.handlePaymentMethodUpserted(event.Data)
+			case "payment_method.detached":
+				err = s.handlePaymentMethodDetached(event.Data)
+			case "invoice.payment_failed":
+				err = s.handleInvoicePaymentFailed(&event)
+			case "payment_intent.succeeded":
+				err = s.handlePaymentIntentSucceeded(event.Data)
 			}
 
 			if err != nil {
@@ -97,9 +112,9 @@ func (s *StripeProvider) Webhook() http.HandlerFunc {
 	}
 }
 
-func (s *StripeProvider) handleSubscriptionCreated(data *stripe.EventData) error {
+func (s *StripeProvider) handleSubscriptionCreated(event *stripe.Event) error {
 	var sub stripe.Subscription
-	if err := sub.UnmarshalJSON(data.Raw); err != nil {
+	if err := sub.UnmarshalJSON(event.Data.Raw); err != nil {
 		return err
 	}
 
@@ -108,12 +123,12 @@ func (s *StripeProvider) handleSubscriptionCreated(data *stripe.EventData) error
 		return err
 	}
 
-	return s.addSubscription(subscr)
+	return s.addSubscription(subscr, eventSource(event))
 }
 
-func (s *StripeProvider) handleSubscriptionUpdated(data *stripe.EventData) error {
+func (s *StripeProvider) handleSubscriptionUpdated(event *stripe.Event) error {
 	var sub stripe.Subscription
-	if err := sub.UnmarshalJSON(data.Raw); err != nil {
+	if err := sub.UnmarshalJSON(event.Data.Raw); err != nil {
 		return err
 	}
 
@@ -122,12 +137,12 @@ func (s *StripeProvider) handleSubscriptionUpdated(data *stripe.EventData) error
 		return err
 	}
 
-	return s.updateSubscriptionByProvider(subscr)
+	return s.updateSubscriptionByProvider(subscr, eventSource(event))
 }
 
-func (s *StripeProvider) handleSubscriptionDeleted(data *stripe.EventData) error {
+func (s *StripeProvider) handleSubscriptionDeleted(event *stripe.Event) error {
 	var sub stripe.Subscription
-	if err := sub.UnmarshalJSON(data.Raw); err != nil {
+	if err := sub.UnmarshalJSON(event.Data.Raw); err != nil {
 		return err
 	}
 
@@ -136,7 +151,7 @@ func (s *StripeProvider) handleSubscriptionDeleted(data *stripe.EventData) error
 		return err
 	}
 
-	return s.removeSubscriptionByProvider(subscr)
+	return s.removeSubscriptionByProvider(subscr, eventSource(event))
 }
 
 func (s *StripeProvider) handleCustomerCreated(data *stripe.EventData) error {
@@ -144,7 +159,7 @@ func (s *StripeProvider) handleCustomerCreated(data *stripe.EventData) error {
 	if err := json.Unmarshal(data.Raw, &c); err != nil {
 		return err
 	}
-	return s.addCustomer(s.convertCustomer(&c))
+	return s.upsertCustomer(s.convertCustomer(&c))
 }
 
 func (s *StripeProvider) handleCustomerUpdated(data *stripe.EventData) error {
@@ -153,7 +168,11 @@ func (s *StripeProvider) handleCustomerUpdated(data *stripe.EventData) error {
 		return err
 	}
 
-	return s.updateCustomerByProvider(s.convertCustomer(&c))
+	if err := s.updateCustomerByProvider(s.convertCustomer(&c)); err != nil {
+		return err
+	}
+
+	return s.updateDefaultPaymentMethod(&c)
 }
 
 func (s *StripeProvider) handleCustomerDeleted(data *stripe.EventData) error {
@@ -175,7 +194,7 @@ func (s *StripeProvider) handlePriceCreated(data *stripe.EventData) error {
 		return err
 	}
 
-	return s.addPrice(pr)
+	return s.upsertPrice(pr)
 }
 
 func (s *StripeProvider) handlePriceUpdated(data *stripe.EventData) error {
@@ -210,7 +229,11 @@ func (s *StripeProvider) handleProductCreated(data *stripe.EventData) error {
 		return err
 	}
 
-	return s.addPlan(s.convertProduct(&p))
+	if err := s.upsertPlan(s.convertProduct(&p)); err != nil {
+		return err
+	}
+
+	return s.syncProductEntitlements(&p)
 }
 
 func (s *StripeProvider) handleProductUpdated(data *stripe.EventData) error {
@@ -219,7 +242,11 @@ func (s *StripeProvider) handleProductUpdated(data *stripe.EventData) error {
 		return err
 	}
 
-	return s.updatePlanByProvider(s.convertProduct(&p))
+	if err := s.updatePlanByProvider(s.convertProduct(&p)); err != nil {
+		return err
+	}
+
+	return s.syncProductEntitlements(&p)
 }
 
 func (s *StripeProvider) handleProductDeleted(data *stripe.EventData) error {
@@ -230,6 +257,38 @@ func (s *StripeProvider) handleProductDeleted(data *stripe.EventData) error {
 	return s.removePlanByProvider(ProviderStripe, p.ID)
 }
 
+func (s *StripeProvider) handleCouponUpserted(data *stripe.EventData) error {
+	var c stripe.Coupon
+	if err := json.Unmarshal(data.Raw, &c); err != nil {
+		return err
+	}
+
+	return s.upsertCoupon(convertCoupon(&c))
+}
+
+func (s *StripeProvider) handleCouponDeleted(data *stripe.EventData) error {
+	var c stripe.Coupon
+	if err := json.Unmarshal(data.Raw, &c); err != nil {
+		return err
+	}
+
+	return s.invalidateCouponByProvider(ProviderStripe, c.ID)
+}
+
+func (s *StripeProvider) handlePromotionCodeUpserted(data *stripe.EventData) error {
+	var pc stripe.PromotionCode
+	if err := json.Unmarshal(data.Raw, &pc); err != nil {
+		return err
+	}
+
+	code, err := s.convertPromotionCode(&pc)
+	if err != nil {
+		return err
+	}
+
+	return s.upsertPromotionCode(code)
+}
+
 func (StripeProvider) convertCustomer(c *stripe.Customer) *Customer {
 	return &Customer{
 		ProviderID: c.ID,
@@ -246,6 +305,7 @@ func (StripeProvider) convertProduct(p *stripe.Product) *Plan {
 		Provider:    ProviderStripe,
 		ProviderID:  p.ID,
 		Active:      p.Active,
+		MaxSeats:    maxSeats(p.Metadata),
 	}
 }
 
@@ -261,25 +321,91 @@ func (s *StripeProvider) convertPrice(p *stripe.Price) (*Price, error) {
 		Amount:     p.UnitAmount,
 		Currency:   string(p.Currency),
 		Schedule:   s.convertPricingSchedule(p),
-		TrialDays:  int(p.Recurring.TrialPeriodDays), // TODO: check if this is actually sent through in the webhook
 		PlanID:     pl.ID,
+		Active:     p.Active,
+		Nickname:   p.Nickname,
+		Metadata:   Metadata{},
+	}
+
+	// prices without metadata are stored as an empty object, so a nil map would never equal the stored price
+	for k, v := range p.Metadata {
+		pr.Metadata[k] = v
+	}
+
+	// one-time prices have no recurring details
+	if p.Recurring != nil {
+		pr.TrialDays = int(p.Recurring.TrialPeriodDays)
+		if p.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
+			pr.Meter = priceMeter(p)
+		}
 	}
 
 	return pr, nil
 }
 
+// handlePaymentIntentSucceeded records one-time payments.
+// Payment intents of invoices belong to subscriptions and are not recorded
+func (s *StripeProvider) handlePaymentIntentSucceeded(data *stripe.EventData) error {
+	var pi stripe.PaymentIntent
+	if err := json.Unmarshal(data.Raw, &pi); err != nil {
+		return err
+	}
+
+	if pi.Invoice != nil {
+		return nil
+	}
+
+	if pi.Customer == nil {
+		return fmt.Errorf("payment intent %s has no customer", pi.ID)
+	}
+
+	if _, err := s.GetPaymentByProvider(ProviderStripe, pi.ID); err == nil {
+		return nil
+	}
+
+	cust, err := s.GetCustomerByProvider(ProviderStripe, pi.Customer.ID)
+	if err != nil {
+		return fmt.Errorf("could not get customer with provider_id = %s for payment %s: %w", pi.Customer.ID, pi.ID, err)
+	}
+
+	p := Payment{
+		Provider:   ProviderStripe,
+		ProviderID: pi.ID,
+		CustomerID: &cust.ID,
+		Amount:     pi.AmountReceived,
+		Currency:   string(pi.Currency),
+		CreatedAt:  time.Unix(pi.Created, 0),
+	}
+
+	if id, err := strconv.ParseInt(pi.Metadata[MetadataPriceID], 10, 64); err == nil {
+		p.PriceID = &id
+	}
+
+	return s.addPayment(&p)
+}
+
 func (s *StripeProvider) convertSubscription(sub *stripe.Subscription) (*Subscription, error) {
-	// ensure that the first item is a subscription
-	if sub.Items == nil ||
-		len(sub.Items.Data) == 0 ||
-		sub.Items.Data[0].Price == nil {
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
 		return nil, errors.New("unable to get price id from subscription")
 	}
 
-	priceID := sub.Items.Data[0].Price.ID
-	pr, err := s.GetPriceByProvider(ProviderStripe, priceID)
-	if err != nil {
-		return nil, fmt.Errorf("could not get price %s: %w", priceID, err)
+	var items []SubscriptionItem
+	for _, item := range sub.Items.Data {
+		if item.Price == nil {
+			return nil, fmt.Errorf("subscription item %s has no price", item.ID)
+		}
+
+		pr, err := s.GetPriceByProvider(ProviderStripe, item.Price.ID)
+		if err != nil {
+			return nil, fmt.Errorf("could not get price %s: %w", item.Price.ID, err)
+		}
+
+		items = append(items, SubscriptionItem{
+			Provider:   ProviderStripe,
+			ProviderID: item.ID,
+			PriceID:    pr.ID,
+			Quantity:   item.Quantity,
+		})
 	}
 
 	cust, err := s.GetCustomerByProvider(ProviderStripe, sub.Customer.ID)
@@ -289,13 +415,41 @@ func (s *StripeProvider) convertSubscription(sub *stripe.Subscription) (*Subscri
 	}
 
 	subscr := Subscription{
-		Provider:   ProviderStripe,
-		ProviderID: sub.ID,
-		CustomerID: cust.ID,
-		PriceID:    pr.ID,
-		Active:     sub.Status == stripe.SubscriptionStatusActive || sub.Status == stripe.SubscriptionStatusTrialing,
-		CreatedAt:  time.Unix(sub.Created, 0),
+		Provider:           ProviderStripe,
+		ProviderID:         sub.ID,
+		CustomerID:         cust.ID,
+		PriceID:            items[0].PriceID,
+		Active:             sub.Status == stripe.SubscriptionStatusActive || sub.Status == stripe.SubscriptionStatusTrialing, // past due subscriptions are kept active by the dunning policy
+		CreatedAt:          time.Unix(sub.Created, 0),
+		Status:             string(sub.Status),
+		CurrentPeriodStart: time.Unix(sub.CurrentPeriodStart, 0),
+		CurrentPeriodEnd:   time.Unix(sub.CurrentPeriodEnd, 0),
+		TrialEnd:           convertTimestamp(sub.TrialEnd),
+		CancelAt:           convertTimestamp(sub.CancelAt),
+		CancelAtPeriodEnd:  sub.CancelAtPeriodEnd,
+		CanceledAt:         convertTimestamp(sub.CanceledAt),
+		Quantity:           items[0].Quantity,
+		CollectionPaused:   sub.PauseCollection != nil && sub.PauseCollection.Behavior != "",
+		Items:              items,
+	}
+
+	if err := s.convertDiscount(&subscr, sub.Discount); err != nil {
+		return nil, fmt.Errorf("could not get discount of subscription %s: %w", sub.ID, err)
+	}
+
+	if err := s.applyDunning(&subscr); err != nil {
+		return nil, fmt.Errorf("could not get grace period of subscription %s: %w", sub.ID, err)
 	}
 
 	return &subscr, nil
 }
+
+// convertTimestamp converts an optional unix timestamp, where zero means the time is not set
+func convertTimestamp(ts int64) *time.Time {
+	if ts == 0 {
+		return nil
+	}
+
+	t := time.Unix(ts, 0)
+	return &t
+}
@@ -0,0 +1,50 @@
+package templates
+
+import "context"
+
+type usernameKey struct{}
+
+// WithUsername returns a context carrying the username of the signed in user, which is shown in the layout
+func WithUsername(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, usernameKey{}, username)
+}
+
+// username returns the username of the signed in user or an empty string
+func username(ctx context.Context) string {
+	u, _ := ctx.Value(usernameKey{}).(string)
+	return u
+}
+
+// Username returns the username of the signed in user for handlers, which is empty when authentication is disabled
+func Username(ctx context.Context) string {
+	return username(ctx)
+}
+
+// CSRFField is the name of the form field carrying the csrf token
+const CSRFField = "csrf_token"
+
+type csrfTokenKey struct{}
+
+// WithCSRFToken returns a context carrying the csrf token that forms have to submit
+func WithCSRFToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, csrfTokenKey{}, token)
+}
+
+// csrfToken returns the csrf token of the request or an empty string
+func csrfToken(ctx context.Context) string {
+	t, _ := ctx.Value(csrfTokenKey{}).(string)
+	return t
+}
+
+type apiDocsKey struct{}
+
+// WithAPIDocs returns a context marking that the api reference page is served, which links it in the layout
+func WithAPIDocs(ctx context.Context) context.Context {
+	return context.WithValue(ctx, apiDocsKey{}, true)
+}
+
+// apiDocs is true when the api reference page is served
+func apiDocs(ctx context.Context) bool {
+	enabled, _ := ctx.Value(apiDocsKey{}).(bool)
+	return enabled
+}
@@ -0,0 +1,215 @@
+package templates
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cristosal/cent/pay"
+)
+
+// CustomerSubscription is a subscription shown on the customer page along with its plan, price and seats
+type CustomerSubscription struct {
+	Subscription pay.Subscription
+	Plan         pay.Plan
+	Price        pay.Price
+	Usernames    []string
+}
+
+// renewal describes when the subscription renews, ends or ended
+func renewal(s pay.Subscription) string {
+	const layout = "2006-01-02"
+	switch {
+	case s.CanceledAt != nil:
+		return fmt.Sprintf("Canceled %s", s.CanceledAt.Format(layout))
+	case s.CancelAt != nil:
+		return fmt.Sprintf("Ends %s", s.CancelAt.Format(layout))
+	case s.CancelAtPeriodEnd:
+		return fmt.Sprintf("Ends %s", s.CurrentPeriodEnd.Format(layout))
+	case s.Status == pay.SubscriptionStatusTrialing && s.TrialEnd != nil:
+		return fmt.Sprintf("Trial ends %s", s.TrialEnd.Format(layout))
+	case s.Renews():
+		return fmt.Sprintf("Renews %s", s.CurrentPeriodEnd.Format(layout))
+	}
+
+	return ""
+}
+
+// status shows the status of a subscription along with when a past due subscription loses access
+func status(s pay.Subscription) string {
+	if s.GraceEnd == nil {
+		return s.Status
+	}
+
+	if s.Active {
+		return fmt.Sprintf("%s (grace until %s)", s.Status, s.GraceEnd.Format("2006-01-02"))
+	}
+
+	return fmt.Sprintf("%s (grace ended %s)", s.Status, s.GraceEnd.Format("2006-01-02"))
+}
+
+// maxSeats is the value of the max seats input, which is left empty when seats are bought as quantity
+func maxSeats(p pay.Plan) string {
+	if p.MaxSeats == 0 {
+		return ""
+	}
+
+	return fmt.Sprint(p.MaxSeats)
+}
+
+// couponDiscount describes how much a coupon takes off
+func couponDiscount(c pay.Coupon) string {
+	if c.PercentOff > 0 {
+		return fmt.Sprintf("%g%% off", c.PercentOff)
+	}
+
+	return fmt.Sprintf("%d %s off", c.AmountOff, c.Currency)
+}
+
+// couponDuration describes for how long a coupon discounts a subscription
+func couponDuration(c pay.Coupon) string {
+	if c.Duration == pay.CouponRepeating {
+		return fmt.Sprintf("%d months", c.DurationInMonths)
+	}
+
+	return c.Duration
+}
+
+// couponLabel names a coupon in select options
+func couponLabel(c pay.Coupon) string {
+	name := c.Name
+	if name == "" {
+		name = c.ProviderID
+	}
+
+	return fmt.Sprintf("%s - %s %s", name, couponDiscount(c), couponDuration(c))
+}
+
+// discount describes the discount of a subscription
+func discount(s pay.Subscription, coupons []pay.Coupon) string {
+	if s.CouponID == nil {
+		return ""
+	}
+
+	for _, c := range coupons {
+		if c.ID != *s.CouponID {
+			continue
+		}
+
+		if s.DiscountEnd != nil {
+			return fmt.Sprintf("%s until %s", couponDiscount(c), s.DiscountEnd.Format("2006-01-02"))
+		}
+
+		return couponDiscount(c)
+	}
+
+	return ""
+}
+
+// redemptions shows how often a coupon or code was redeemed out of its limit
+func redemptions(times, max int64) string {
+	if max == 0 {
+		return fmt.Sprint(times)
+	}
+
+	return fmt.Sprintf("%d of %d", times, max)
+}
+
+// optionalID shows an id that may not be set
+func optionalID(id *int64) string {
+	if id == nil {
+		return ""
+	}
+
+	return fmt.Sprint(*id)
+}
+
+// optionalDate formats a date that may not be set, as used by date inputs
+func optionalDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format("2006-01-02")
+}
+
+// nonZero is the value of a number input, which is left empty for zero
+func nonZero[T int64 | float64](n T) string {
+	if n == 0 {
+		return ""
+	}
+
+	return fmt.Sprint(n)
+}
+
+// cardLabel shows the brand and last digits of a card, or the type of other payment methods
+func cardLabel(pm pay.PaymentMethod) string {
+	if pm.Last4 == "" {
+		return pm.Type
+	}
+
+	return fmt.Sprintf("%s •••• %s", pm.Brand, pm.Last4)
+}
+
+// cardExpiry shows the expiry month of a card
+func cardExpiry(pm pay.PaymentMethod) string {
+	if pm.ExpYear == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%02d/%d", pm.ExpMonth, pm.ExpYear)
+}
+
+// FormErrors maps form fields to validation messages.
+// Errors which do not belong to a single field are stored under the empty key.
+type FormErrors map[string]string
+
+// Has is true when there is at least one error
+func (e FormErrors) Has() bool {
+	return len(e) > 0
+}
+
+// invalid returns the value of the aria-invalid attribute for field
+func invalid(errs FormErrors, field string) string {
+	if _, exists := errs[field]; exists {
+		return "true"
+	}
+
+	return ""
+}
+
+const (
+	chartBarWidth = 24
+	chartHeight   = 200
+)
+
+// barHeight scales count to half the chart height relative to the largest count in periods
+func barHeight(count int64, periods []pay.SubscriptionPeriod) int64 {
+	var max int64
+	for _, p := range periods {
+		if p.New > max {
+			max = p.New
+		}
+
+		if p.Churned > max {
+			max = p.Churned
+		}
+	}
+
+	if max == 0 {
+		return 0
+	}
+
+	return count * (chartHeight / 2) / max
+}
+
+// maxPlanMRR returns the highest monthly revenue of the plans in currency
+func maxPlanMRR(plans []pay.PlanRevenue, currency string) int64 {
+	var max int64
+	for _, p := range plans {
+		if p.Currency == currency && p.MRR > max {
+			max = p.MRR
+		}
+	}
+
+	return max
+}